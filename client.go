@@ -3,6 +3,7 @@ package minirpc
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,6 +28,12 @@ type Call struct {
 	Args interface{}
 	// 方法的返回值
 	Reply interface{}
+	// 随请求发送的 metadata
+	Metadata Metadata
+	// 服务端在回复中附带的 metadata
+	ReplyMetadata Metadata
+	// 调用的截止时间，零值表示没有
+	deadline time.Time
 	// 返回的错误信息
 	Err error
 	// 方法调用结束时的信号
@@ -46,6 +53,8 @@ type Client struct {
 	option Option
 	// 发送数据的互斥锁
 	sending sync.Mutex
+	// 发送请求时复用的 header，由 sending 保护
+	header codec.Header
 	// Client 操作的互斥锁
 	lock sync.Mutex
 	// 当前发送的序号
@@ -56,6 +65,15 @@ type Client struct {
 	closed bool
 	// 客户端非正常退出
 	shutdown bool
+	// 服务端正在关闭，不再发送新的请求，已发送的请求全部返回后断开连接
+	draining bool
+	// 客户端不再接受新的调用时关闭，即 Avaliable 变为 false 时
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// 服务端在握手时告知的幂等方法
+	idempotent map[string]struct{}
+	// 客户端的拦截器，由 lock 保护
+	interceptors []Interceptor
 }
 
 var _ io.Closer = (*Client)(nil)
@@ -69,9 +87,15 @@ func (client *Client) Close() error {
 		return ErrClientShutdown
 	}
 	client.closed = true
+	client.stop()
 	return client.cc.Close()
 }
 
+// 通知客户端已经不可用
+func (client *Client) stop() {
+	client.stopOnce.Do(func() { close(client.stopped) })
+}
+
 // 判断客户端是否可用
 func (client *Client) Avaliable() bool {
 	client.lock.Lock()
@@ -79,9 +103,16 @@ func (client *Client) Avaliable() bool {
 	return client.avaliable()
 }
 
+// 服务端是否已经通知关闭，此时连接在已发送的请求全部返回后自行断开
+func (client *Client) Draining() bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.draining
+}
+
 // 内部使用的 avvaliable 方法，无锁
 func (client *Client) avaliable() bool {
-	return !client.shutdown && !client.closed
+	return !client.shutdown && !client.closed && !client.draining
 }
 
 // 将 call 加入到 client 的 pending 中，并更新 seq
@@ -107,6 +138,17 @@ func (client *Client) removeCall(seq uint64) *Call {
 	return call
 }
 
+// 服务端正在关闭且所有请求都已返回时断开连接
+// 只在接收协程读完一个完整的响应后，或者取消一个请求后调用
+func (client *Client) closeIfDrained() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.draining && len(client.pending) == 0 && !client.closed && !client.shutdown {
+		client.shutdown = true
+		_ = client.cc.Close()
+	}
+}
+
 // 当服务端或客户端发生错误时调用
 // 异常退出 client，终止所有调用并通知其对应的 error
 func (client *Client) terminateCalls(err error) {
@@ -115,7 +157,9 @@ func (client *Client) terminateCalls(err error) {
 	client.lock.Lock()
 	defer client.lock.Unlock()
 	client.shutdown = true
-	for _, call := range client.pending {
+	client.stop()
+	for seq, call := range client.pending {
+		delete(client.pending, seq)
 		call.Err = err
 		call.done()
 	}
@@ -124,59 +168,123 @@ func (client *Client) terminateCalls(err error) {
 // 循环接收服务端发送的数据，分为 header 和 body 两部分
 func (client *Client) recieve() {
 	var err error
+	var header codec.Header
 	// 只有在出错的时候才退出循环
 	for err == nil {
-		var header codec.Header
+		header = codec.Header{}
 		if err = client.cc.ReadHeader(&header); err != nil {
-			// if err != io.EOF && err != io.ErrUnexpectedEOF {
-			// 	logrus.Errorf("read header error: %v", err)
-			// }
-			return
+			break
+		}
+		// 服务端正在关闭，不再发送新的请求
+		if header.Seq == 0 && header.ServiceMethod == goAwayServiceMethod {
+			client.lock.Lock()
+			client.draining = true
+			client.stop()
+			client.lock.Unlock()
+			if err = client.cc.ReadBody(nil); err == nil {
+				client.closeIfDrained()
+			}
+			continue
 		}
 		call := client.removeCall(header.Seq)
+		if call != nil {
+			call.ReplyMetadata = header.Metadata
+		}
 		if call == nil {
 			err = client.cc.ReadBody(nil)
-			continue
 		} else if header.Error != "" {
-			call.Err = errors.New(header.Error)
+			call.Err = statusFromHeader(&header)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		} else {
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil {
-				call.Err = errors.New("reading body " + err.Error())
+				call.Err = fmt.Errorf("reading body: %w", err)
 			}
 			call.done()
 		}
+		// 超长的帧已经被跳过，不支持 RawMessage 的编码器也已经读取完 body，只影响当前的调用
+		if codec.Recoverable(err) || errors.Is(err, codec.ErrRawMessageNotSupported) {
+			err = nil
+		}
+		if err == nil {
+			client.closeIfDrained()
+		}
 	}
-	client.terminateCalls(errors.New("recieve error"))
+	client.terminateCalls(fmt.Errorf("rpc client: recieve error: %w", err))
 }
 
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
-	newCodecFunc := codec.NewCodecFuncMap[opt.CodecType]
-	if newCodecFunc == nil {
+	if _, ok := codec.Lookup(opt.CodecType); !ok {
 		return nil, fmt.Errorf("unsupported codec type: %v", opt.CodecType)
 	}
-	cc := newCodecFunc(conn)
+	// 启用加密时附带客户端的随机数，不修改调用者传入的 option
+	request := *opt
+	if opt.PreSharedKey != nil {
+		request.ClientNonce = make([]byte, codec.NonceSize)
+		if _, err := rand.Read(request.ClientNonce); err != nil {
+			return nil, err
+		}
+	}
 	// 发送 option
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
+	if err := json.NewEncoder(conn).Encode(&request); err != nil {
 		return nil, err
 	}
-	// 两次握手，解决 TCP 粘包问题
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	// 两次握手，解决 TCP 粘包问题，服务端会在回复中确认协商的结果
+	var reply Option
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
 		logrus.Error(err)
 		return nil, err
 	}
+	if reply.CodecType == "" {
+		return nil, fmt.Errorf("%w: %v, server supports %v",
+			ErrCodecNotSupported, append([]codec.Type{opt.CodecType}, opt.Codecs...), reply.Codecs)
+	}
+	// 服务端选择的编码只会是客户端提出的编码之一
+	newCodecFunc, ok := codec.Lookup(reply.CodecType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec type: %v", reply.CodecType)
+	}
+	if opt.PreSharedKey == nil && len(reply.ServerNonce) != 0 {
+		return nil, errors.New("rpc client: server requires encryption")
+	}
+	if opt.PreSharedKey != nil {
+		if len(reply.ServerNonce) != codec.NonceSize {
+			return nil, errors.New("rpc client: server does not support encryption")
+		}
+		clientKey, serverKey := codec.DeriveKeys(opt.PreSharedKey, request.ClientNonce, reply.ServerNonce)
+		var err error
+		if newCodecFunc, err = codec.Secure(newCodecFunc, clientKey, serverKey); err != nil {
+			return nil, err
+		}
+	}
+	option := request
+	option.CodecType = reply.CodecType
+	option.Compression = reply.Compression
+	option.ServerNonce = reply.ServerNonce
+	option.IdempotentMethods = reply.IdempotentMethods
+	idempotent := make(map[string]struct{}, len(reply.IdempotentMethods))
+	for _, m := range reply.IdempotentMethods {
+		idempotent[m] = struct{}{}
+	}
+	cc := newCodecFunc(conn, &codec.Config{
+		MaxFrameSize:      option.MaxFrameSize,
+		Checksum:          option.Checksum,
+		Compression:       option.Compression,
+		CompressThreshold: option.CompressThreshold,
+	})
 
 	client := &Client{
-		cc:       cc,
-		option:   *opt,
-		pending:  make(map[uint64]*Call),
-		closed:   false,
-		shutdown: false,
-		seq:      1,
-		sending:  sync.Mutex{},
-		lock:     sync.Mutex{},
+		cc:         cc,
+		option:     option,
+		pending:    make(map[uint64]*Call),
+		closed:     false,
+		shutdown:   false,
+		seq:        1,
+		stopped:    make(chan struct{}),
+		idempotent: idempotent,
+		sending:    sync.Mutex{},
+		lock:       sync.Mutex{},
 	}
 	go client.recieve()
 	return client, nil
@@ -253,23 +361,41 @@ func dialTimeout(f NewClientFunc, network, address string, opts ...*Option) (cli
 
 // 发送数据
 func (client *Client) send(call *Call) {
-	client.sending.Lock()
-	defer client.sending.Unlock()
 	seq, err := client.registerCall(call)
 	if err != nil {
 		call.Err = err
 		call.done()
 		return
 	}
+	client.write(call, seq)
+}
+
+// 发送已经注册的调用，写入前调用已经被移除（如被取消）时不再发送
+func (client *Client) write(call *Call, seq uint64) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	client.lock.Lock()
+	_, ok := client.pending[seq]
+	client.lock.Unlock()
+	if !ok {
+		return
+	}
 
 	// 构造 header
-	header := codec.Header{
-		ServiceMethod: call.ServiceMethod,
-		Seq:           seq,
-		Error:         "",
+	header := &client.header
+	header.ServiceMethod = call.ServiceMethod
+	header.Seq = seq
+	header.Error = ""
+	header.Metadata = call.Metadata
+	header.Timeout = 0
+	if !call.deadline.IsZero() {
+		// 剩余时间恰好为 0 时同样视为已经过期
+		if header.Timeout = time.Until(call.deadline); header.Timeout <= 0 {
+			header.Timeout = -1
+		}
 	}
 	// 发送 header 和 参数
-	if err := client.cc.Write(&header, call.Args); err != nil {
+	if err := client.cc.Write(header, call.Args); err != nil {
 		call := client.removeCall(seq)
 		if call != nil {
 			call.Err = err
@@ -278,35 +404,114 @@ func (client *Client) send(call *Call) {
 	}
 }
 
+// 通知服务端放弃 seq 对应的请求，服务端不会再回复它
+func (client *Client) cancel(seq uint64) {
+	client.sending.Lock()
+	header := codec.Header{ServiceMethod: cancelServiceMethod, Seq: seq}
+	_ = client.cc.Write(&header, invalidRequest)
+	client.sending.Unlock()
+	// 服务端正在关闭时，最后一个请求被取消后不会再有响应，需要在这里断开连接
+	client.closeIfDrained()
+}
+
 // 对服务器发起调用
 // 异步接口，直接返回 call 实例
+// 设置了拦截器或 RetryPolicy 时，与 GoContext(context.Background(), ...) 相同
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	if client.option.RetryPolicy != nil || len(client.getInterceptors()) > 0 {
+		return client.GoContext(context.Background(), serviceMethod, args, reply, done)
+	}
+	call := newCall(serviceMethod, args, reply, done)
+	go client.send(call)
+	return call
+}
+
+// 带有 context 的异步调用，ctx 的 metadata、截止时间和取消与 Call 中的相同
+// 调用在单独的协程中经过 Call 发起，返回的 call 的 Seq 始终为 0
+func (client *Client) GoContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	call := newCall(serviceMethod, args, reply, done)
+	call.Metadata, _ = OutgoingMetadata(ctx)
+	go func() {
+		call.Err = client.Call(WithReplyMetadata(ctx, &call.ReplyMetadata), serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+func newCall(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 1)
 	}
-	call := &Call{
+	return &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Err:           nil,
 		Done:          done,
 	}
-	go client.send(call)
-	return call
+}
+
+// 同步调用使用的 Call 不会暴露给调用者，可以连同其 Done 一起复用
+var callPool = sync.Pool{
+	New: func() interface{} {
+		return &Call{Done: make(chan *Call, 1)}
+	},
 }
 
 // 对服务器发起调用，并等待返回
+// 通过 WithMetadata 附加在 ctx 中的 metadata 会随请求发送
+// 服务端回复中的 metadata 可以通过 WithReplyMetadata 接收
 // 在 context 超时时会返回错误
+// 设置了 Option.RetryPolicy 时，可以重试的失败调用会在同一个连接上重试
+// 通过 Use 添加的拦截器包裹整个调用，包括其中的重试
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	if interceptors := client.getInterceptors(); len(interceptors) > 0 {
+		return ChainInterceptors(interceptors, client.invoke)(ctx, serviceMethod, args, reply)
+	}
+	return client.invoke(ctx, serviceMethod, args, reply)
+}
+
+// 不经过拦截器，直接发起调用
+func (client *Client) invoke(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	if client.option.RetryPolicy != nil {
+		return client.callWithRetry(ctx, serviceMethod, args, reply)
+	}
+	return client.call(ctx, serviceMethod, args, reply)
+}
+
+func (client *Client) call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := callPool.Get().(*Call)
+	call.ServiceMethod = serviceMethod
+	call.Args = args
+	call.Reply = reply
+	call.Metadata, _ = OutgoingMetadata(ctx)
+	// 截止时间随请求发送给服务端，服务端处理请求时会继承它
+	call.deadline, _ = ctx.Deadline()
+	seq, err := client.registerCall(call)
+	if err != nil {
+		*call = Call{Done: call.Done}
+		callPool.Put(call)
+		return err
+	}
+	// 写入可能因为连接阻塞，在单独的协程中进行，以便 ctx 结束时及时返回
+	go client.write(call, seq)
 	select {
 	case <-ctx.Done():
-		// 如果超时，则取消发送
-		client.removeCall(call.Seq)
-		err := fmt.Errorf("rpc client: call timeout expect within %v", ctx.Err())
+		// 如果超时，则取消调用，并通知服务端停止处理
+		// 此时 call 可能仍被发送或接收协程持有，不能放回池中
+		if client.removeCall(seq) != nil {
+			go client.cancel(seq)
+		}
+		err := fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+		return err
+	case <-call.Done:
+		err := call.Err
+		if md, ok := ctx.Value(replyReceiverKey{}).(*Metadata); ok {
+			*md = call.ReplyMetadata
+		}
+		*call = Call{Done: call.Done}
+		callPool.Put(call)
 		return err
-	case call := <-call.Done:
-		return call.Err
 	}
 }
 
@@ -0,0 +1,67 @@
+package minirpc
+
+import (
+	"context"
+	"minirpc/codec"
+	"net"
+	"testing"
+)
+
+// 在本地回环地址上启动一个只注册了 Foo 的服务器
+func startBenchServer(b *testing.B) string {
+	server := NewServer()
+	_ = server.Register(Foo{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+	go server.Accept(listener)
+	return listener.Addr().String()
+}
+
+func benchmarkCall(b *testing.B, opt *Option) {
+	client, err := DialTCP("tcp", startBenchServer(b), opt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+	args := Args{A: 1, B: 2}
+	var reply int
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Call(ctx, "Foo.Sum", args, &reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClient_Call(b *testing.B) {
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		b.Run(string(typ), func(b *testing.B) {
+			benchmarkCall(b, &Option{CodecType: typ})
+		})
+	}
+}
+
+func BenchmarkClient_CallParallel(b *testing.B) {
+	client, err := DialTCP("tcp", startBenchServer(b), &Option{CodecType: codec.GobType})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		args := Args{A: 1, B: 2}
+		var reply int
+		for pb.Next() {
+			if err := client.Call(ctx, "Foo.Sum", args, &reply); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -2,10 +2,17 @@ package minirpc
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"minirpc/codec"
 	"net"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -56,6 +63,20 @@ func startServer(addr chan string) {
 	Accept(listener)
 }
 
+// 启动一个监听随机端口的服务器，返回服务器和它的地址，测试结束时关闭服务器
+// 服务和拦截器可以在返回后再注册
+func startTestServer(t *testing.T, opts ...ServerOption) (*Server, string) {
+	t.Helper()
+	server := NewServer(opts...)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(listener)
+	t.Cleanup(func() { _ = server.Close() })
+	return server, listener.Addr().String()
+}
+
 func TestClient_Call(t *testing.T) {
 	t.Parallel()
 	addrCh := make(chan string)
@@ -83,13 +104,11 @@ func TestClient_Call(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 		defer cancel()
 		var reply int
 		err = client.Call(ctx, "Bar.Timeout", 1, &reply)
-		if err == nil {
-			t.Fatal("should timeout")
-		}
+		_assert(t, errors.Is(err, ErrHandleTimeout), "expect ErrHandleTimeout, got %v", err)
 	})
 }
 
@@ -116,3 +135,1040 @@ func TestClient_XDial(t *testing.T) {
 		}
 	}
 }
+
+func TestClient_Codecs(t *testing.T) {
+	t.Parallel()
+	server, addr := startTestServer(t)
+	_ = server.Register(Foo{})
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := DialTCP("tcp", addr, &Option{
+				CodecType: typ,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			var reply int
+			err = client.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &reply, time.Second)
+			_assert(t, err == nil, "call failed: %v", err)
+			_assert(t, reply == 3, "expect 3, got %d", reply)
+		})
+	}
+}
+
+type Echo struct{}
+
+func (e Echo) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func TestClient_Compression(t *testing.T) {
+	t.Parallel()
+	server, addr := startTestServer(t)
+	_ = server.Register(Echo{})
+
+	args := strings.Repeat("minirpc ", 1024)
+	cases := []struct {
+		request, accepted codec.Compression
+	}{
+		{codec.CompressionGzip, codec.CompressionGzip},
+		{codec.CompressionFlate, codec.CompressionFlate},
+		{codec.CompressionZlib, codec.CompressionZlib},
+		// 服务端不支持的算法回退为不压缩
+		{"br", codec.CompressionNone},
+	}
+	for _, c := range cases {
+		t.Run(string(c.request), func(t *testing.T) {
+			client, err := DialTCP("tcp", addr, &Option{
+				Compression: c.request,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			_assert(t, client.option.Compression == c.accepted,
+				"expect %q, got %q", c.accepted, client.option.Compression)
+			var reply string
+			err = client.CallTimeout("Echo.Echo", args, &reply, time.Second)
+			_assert(t, err == nil, "call failed: %v", err)
+			_assert(t, reply == args, "reply mismatch")
+		})
+	}
+}
+
+// 超长的请求被服务端跳过后，gob 的连接因为可能丢失类型信息而断开，其他编码的连接继续可用
+func TestServer_FrameTooLarge(t *testing.T) {
+	t.Parallel()
+	server, addr := startTestServer(t, WithMaxFrameSize(512))
+	_ = server.Register(Echo{})
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := DialTCP("tcp", addr, &Option{CodecType: typ})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			var reply string
+			err = client.CallTimeout("Echo.Echo", strings.Repeat("x", 1024), &reply, time.Second)
+			_assert(t, err != nil, "oversized request should fail")
+			err = client.CallTimeout("Echo.Echo", "hi", &reply, time.Second)
+			if typ == codec.GobType {
+				_assert(t, err != nil && !client.Avaliable(), "gob connection should be closed, got %v", err)
+			} else {
+				_assert(t, err == nil && reply == "hi", "call failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestClient_CodecFallback(t *testing.T) {
+	t.Parallel()
+	server, addr := startTestServer(t, WithCodecs(codec.JsonType))
+	_ = server.Register(Foo{})
+
+	t.Run("fallback", func(t *testing.T) {
+		client, err := DialTCP("tcp", addr, &Option{
+			CodecType: codec.GobType,
+			Codecs:    []codec.Type{codec.MsgpackType, codec.JsonType},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		_assert(t, client.option.CodecType == codec.JsonType, "expect json, got %q", client.option.CodecType)
+		var reply int
+		err = client.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &reply, time.Second)
+		_assert(t, err == nil && reply == 3, "call failed: %v", err)
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := DialTCP("tcp", addr, &Option{
+			CodecType: codec.GobType,
+		})
+		_assert(t, errors.Is(err, ErrCodecNotSupported), "expect ErrCodecNotSupported, got %v", err)
+	})
+}
+
+func TestClient_PreSharedKey(t *testing.T) {
+	t.Parallel()
+	psk := []byte("minirpc pre-shared key")
+	server, addr := startTestServer(t, WithPreSharedKey(psk))
+	_ = server.Register(Foo{})
+
+	t.Run("encrypted", func(t *testing.T) {
+		client, err := DialTCP("tcp", addr, &Option{
+			PreSharedKey: psk,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		var reply int
+		err = client.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &reply, time.Second)
+		_assert(t, err == nil && reply == 3, "call failed: %v", err)
+	})
+	t.Run("plain", func(t *testing.T) {
+		_, err := DialTCP("tcp", addr, &Option{})
+		_assert(t, err != nil, "server should reject plain connection")
+	})
+}
+
+// 不关心具体类型的代理，将请求原样转发给后端的 Foo.Sum
+type Proxy struct {
+	backend *Client
+}
+
+func (p Proxy) Forward(args codec.RawMessage, reply *codec.RawMessage) error {
+	return p.backend.CallTimeout("Foo.Sum", args, reply, time.Second)
+}
+
+func TestClient_RawMessage(t *testing.T) {
+	t.Parallel()
+	backendServer, backendAddr := startTestServer(t)
+	_ = backendServer.Register(Foo{})
+	opt := &Option{CodecType: codec.JsonType}
+	backend, err := DialTCP("tcp", backendAddr, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	proxyServer, proxyAddr := startTestServer(t)
+	_ = proxyServer.Register(Proxy{backend})
+	client, err := DialTCP("tcp", proxyAddr, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var reply int
+	err = client.CallTimeout("Proxy.Forward", Args{A: 1, B: 2}, &reply, time.Second)
+	_assert(t, err == nil && reply == 3, "call failed: %v", err)
+
+	var raw codec.RawMessage
+	err = client.CallTimeout("Proxy.Forward", codec.RawMessage(`{"A":2,"B":3}`), &raw, time.Second)
+	_assert(t, err == nil && string(raw) == "5", "call failed: %v, %s", err, raw)
+
+	// gob 不支持 RawMessage，只有对应的调用失败，连接依然可用
+	_ = backendServer.RegisterFunc("Raw.Get", func(args int, reply *codec.RawMessage) error {
+		*reply = codec.RawMessage("raw")
+		return nil
+	})
+	gob, err := DialTCP("tcp", backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gob.Close()
+	err = gob.CallTimeout("Raw.Get", 1, &reply, time.Second)
+	_assert(t, errors.Is(err, &Status{Code: CodeInternal}), "expect CodeInternal, got %v", err)
+	err = gob.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &raw, time.Second)
+	_assert(t, errors.Is(err, codec.ErrRawMessageNotSupported), "expect ErrRawMessageNotSupported, got %v", err)
+	err = gob.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &reply, time.Second)
+	_assert(t, err == nil && reply == 3, "call failed: %v", err)
+}
+
+// 接收 context.Context 的服务，done 用于观察 ctx 被取消的原因
+type Waiter struct {
+	done chan error
+}
+
+func (w Waiter) Trace(ctx context.Context, args string, reply *string) error {
+	md, _ := MetadataFromContext(ctx)
+	*reply = args + md["trace-id"]
+	return SetReplyMetadata(ctx, Metadata{"trace-id": md["trace-id"], "server": "waiter"})
+}
+
+func (w Waiter) Wait(ctx context.Context, args int, reply *int) error {
+	<-ctx.Done()
+	w.done <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestClient_ContextAware(t *testing.T) {
+	t.Parallel()
+	waiter := Waiter{done: make(chan error, 1)}
+	server, addr := startTestServer(t)
+	_ = server.Register(waiter)
+
+	t.Run("metadata", func(t *testing.T) {
+		client, err := DialTCP("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		ctx = WithMetadata(ctx, Metadata{"trace-id": "42"})
+		var reply string
+		var replyMD Metadata
+		err = client.Call(WithReplyMetadata(ctx, &replyMD), "Waiter.Trace", "trace:", &reply)
+		_assert(t, err == nil && reply == "trace:42", "call failed: %v, %q", err, reply)
+		_assert(t, replyMD["trace-id"] == "42" && replyMD["server"] == "waiter", "unexpected reply metadata %v", replyMD)
+
+		call := <-client.GoContext(WithMetadata(ctx, Metadata{"trace-id": "43"}), "Waiter.Trace", "go:", &reply, nil).Done
+		_assert(t, call.Err == nil && reply == "go:43", "call failed: %v, %q", call.Err, reply)
+		_assert(t, call.ReplyMetadata["trace-id"] == "43", "unexpected reply metadata %v", call.ReplyMetadata)
+		call = <-client.Go("Waiter.Trace", "go:", &reply, nil).Done
+		_assert(t, call.Err == nil && call.ReplyMetadata["server"] == "waiter", "unexpected reply metadata %v", call.ReplyMetadata)
+	})
+	t.Run("handle timeout", func(t *testing.T) {
+		client, err := DialTCP("tcp", addr, &Option{
+			HandleTimeout: 100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		var reply int
+		err = client.CallTimeout("Waiter.Wait", 1, &reply, time.Second)
+		_assert(t, errors.Is(err, ErrHandleTimeout), "expect ErrHandleTimeout, got %v", err)
+		err = <-waiter.done
+		_assert(t, err == context.DeadlineExceeded, "expect context.DeadlineExceeded, got %v", err)
+		// 超时只影响当前的请求，连接仍然可用
+		var trace string
+		err = client.CallTimeout("Waiter.Trace", "trace:", &trace, time.Second)
+		_assert(t, err == nil && trace == "trace:", "call failed: %v", err)
+	})
+	t.Run("connection closed", func(t *testing.T) {
+		client, err := DialTCP("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply int
+		client.Go("Waiter.Wait", 1, &reply, nil)
+		time.Sleep(100 * time.Millisecond)
+		_ = client.Close()
+		select {
+		case err = <-waiter.done:
+			_assert(t, err == context.Canceled, "expect context.Canceled, got %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("handler is not cancelled after the connection closed")
+		}
+	})
+}
+
+func TestServer_Interceptors(t *testing.T) {
+	t.Parallel()
+	var trace []string
+	var mu sync.Mutex
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error {
+			mu.Lock()
+			trace = append(trace, name+":"+serviceMethod)
+			mu.Unlock()
+			return next(ctx, serviceMethod, args, reply)
+		}
+	}
+	auth := func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error {
+		if md, _ := MetadataFromContext(ctx); md["token"] != "secret" {
+			return errors.New("unauthenticated")
+		}
+		return next(ctx, serviceMethod, args, reply)
+	}
+	server, addr := startTestServer(t)
+	server.Use(record("server"))
+	_ = server.RegisterWithInterceptors(Foo{}, record("foo"), auth)
+	_ = server.Register(Echo{})
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var sum int
+	err = client.Call(ctx, "Foo.Sum", Args{A: 1, B: 2}, &sum)
+	_assert(t, err != nil && strings.Contains(err.Error(), "unauthenticated"), "expect unauthenticated, got %v", err)
+	err = client.Call(WithMetadata(ctx, Metadata{"token": "secret"}), "Foo.Sum", Args{A: 1, B: 2}, &sum)
+	_assert(t, err == nil && sum == 3, "call failed: %v", err)
+	var echo string
+	err = client.Call(ctx, "Echo.Echo", "hi", &echo)
+	_assert(t, err == nil && echo == "hi", "call failed: %v", err)
+
+	// 所有注册方式都可以通过 WithServiceInterceptors 指定服务的拦截器
+	_ = server.RegisterName("Bar", Foo{}, WithServiceInterceptors(record("bar")))
+	err = client.Call(ctx, "Bar.Sum", Args{A: 1, B: 2}, &sum)
+	_assert(t, err == nil && sum == 3, "call failed: %v", err)
+	_ = server.Replace("Bar", Foo{}, WithServiceInterceptors(record("baz")))
+	err = client.Call(ctx, "Bar.Sum", Args{A: 1, B: 2}, &sum)
+	_assert(t, err == nil && sum == 3, "call failed: %v", err)
+	sub := func(args Args, reply *int) error {
+		*reply = args.A - args.B
+		return nil
+	}
+	// 同一服务下注册的函数追加服务的拦截器
+	_ = server.RegisterFunc("Calc.Sub", sub, WithServiceInterceptors(record("calc")))
+	_ = server.RegisterFunc("Calc.Add", func(args Args, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	}, WithServiceInterceptors(record("add")))
+	err = client.Call(ctx, "Calc.Sub", Args{A: 3, B: 2}, &sum)
+	_assert(t, err == nil && sum == 1, "call failed: %v", err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	expect := []string{
+		"server:Foo.Sum", "foo:Foo.Sum",
+		"server:Foo.Sum", "foo:Foo.Sum",
+		"server:Echo.Echo",
+		"server:Bar.Sum", "bar:Bar.Sum",
+		"server:Bar.Sum", "baz:Bar.Sum",
+		"server:Calc.Sub", "calc:Calc.Sub", "add:Calc.Sub",
+	}
+	_assert(t, strings.Join(trace, ",") == strings.Join(expect, ","), "unexpected trace: %v", trace)
+}
+
+// 进入方法后阻塞，直到 release 被关闭
+type Gate struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g Gate) Wait(args int, reply *int) error {
+	g.entered <- struct{}{}
+	<-g.release
+	*reply = args
+	return nil
+}
+
+// 只完成握手的连接，用于模拟不使用 Client 的对端
+func dialRaw(t *testing.T, addr string, opt *Option) codec.Codec {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = json.NewEncoder(conn).Encode(opt)
+	var reply Option
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return codec.NewGobCodec(conn, nil)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+	start := func(t *testing.T) (*Server, Gate, string) {
+		gate := Gate{entered: make(chan struct{}, 1), release: make(chan struct{})}
+		server, addr := startTestServer(t)
+		_ = server.Register(gate)
+		return server, gate, addr
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		server, gate, addr := start(t)
+		client, err := DialTCP("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		var reply int
+		call := client.Go("Gate.Wait", 1, &reply, nil)
+		<-gate.entered
+
+		shutdown := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			shutdown <- server.Shutdown(ctx)
+		}()
+		for i := 0; client.Avaliable(); i++ {
+			_assert(t, i < 100, "client is still available after GoAway")
+			time.Sleep(10 * time.Millisecond)
+		}
+		err = client.CallTimeout("Gate.Wait", 2, &reply, time.Second)
+		_assert(t, errors.Is(err, ErrClientShutdown), "expect ErrClientShutdown, got %v", err)
+		_, err = DialTCP("tcp", addr)
+		_assert(t, err != nil, "server should not accept new connections")
+
+		select {
+		case err := <-shutdown:
+			t.Fatalf("shutdown returned before in-flight request finished: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(gate.release)
+		<-call.Done
+		_assert(t, call.Err == nil && reply == 1, "in-flight call failed: %v", call.Err)
+		_assert(t, <-shutdown == nil, "shutdown failed")
+	})
+	t.Run("ignore GoAway", func(t *testing.T) {
+		// 不理会 GoAway 的对端，服务端在请求处理完毕后主动断开连接
+		server, gate, addr := start(t)
+		cc := dialRaw(t, addr, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType})
+		defer cc.Close()
+		_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Wait", Seq: 1}, 1)
+		<-gate.entered
+
+		shutdown := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			shutdown <- server.Shutdown(ctx)
+		}()
+		close(gate.release)
+		select {
+		case err := <-shutdown:
+			_assert(t, err == nil, "shutdown failed: %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("shutdown waits for the peer to disconnect")
+		}
+	})
+	t.Run("force", func(t *testing.T) {
+		server, gate, addr := start(t)
+		defer close(gate.release)
+		client, err := DialTCP("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		var reply int
+		call := client.Go("Gate.Wait", 1, &reply, nil)
+		<-gate.entered
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err = server.Shutdown(ctx)
+		_assert(t, err == context.DeadlineExceeded, "expect context.DeadlineExceeded, got %v", err)
+		<-call.Done
+		_assert(t, call.Err != nil, "in-flight call should fail after force close")
+	})
+}
+
+func TestClient_ServerPanic(t *testing.T) {
+	t.Parallel()
+	server, addr := startTestServer(t)
+	_ = server.Register(Panicker{})
+	_ = server.Register(Foo{})
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var reply int
+	err = client.CallTimeout("Panicker.Boom", 1, &reply, time.Second)
+	var st *Status
+	_assert(t, errors.Is(err, ErrPanic) && errors.As(err, &st) && st.Code == CodePanic && st.Details["method"] == "Panicker.Boom" && st.Details["panic"] == "boom",
+		"expect ErrPanic, got %v", err)
+	// 服务器和连接在 panic 之后仍然可用
+	err = client.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &reply, time.Second)
+	_assert(t, err == nil && reply == 3, "call failed: %v", err)
+}
+
+func TestServer_RegisterWithOptions(t *testing.T) {
+	t.Parallel()
+	waiter := Waiter{done: make(chan error, 1)}
+	server, addr := startTestServer(t)
+	err := server.RegisterWithOptions(waiter,
+		MethodTimeout("Wait", 50*time.Millisecond),
+		MethodRename("Trace", "Echo"),
+	)
+	_assert(t, err == nil, "register failed: %v", err)
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// 客户端没有设置 HandleTimeout，由方法自身的超时生效
+	var reply int
+	err = client.CallTimeout("Waiter.Wait", 1, &reply, time.Second)
+	_assert(t, errors.Is(err, ErrHandleTimeout), "expect ErrHandleTimeout, got %v", err)
+	<-waiter.done
+	var echo string
+	err = client.CallTimeout("Waiter.Echo", "hi", &echo, time.Second)
+	_assert(t, err == nil && echo == "hi", "call failed: %v", err)
+	err = client.CallTimeout("Waiter.Trace", "hi", &echo, time.Second)
+	_assert(t, err != nil, "renamed method should not be callable by its old name")
+}
+
+type Greeter struct {
+	greeting string
+}
+
+func (g Greeter) Greet(name string, reply *string) error {
+	*reply = g.greeting + ", " + name
+	return nil
+}
+
+func TestServer_RegisterName(t *testing.T) {
+	t.Parallel()
+	gate := Gate{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	server, addr := startTestServer(t)
+	_assert(t, server.RegisterName("Hello", Greeter{"hello"}) == nil, "register failed")
+	_assert(t, server.RegisterName("Hi", Greeter{"hi"}) == nil, "register failed")
+	_assert(t, server.RegisterName("Hi", Greeter{"hi"}) != nil, "duplicate name should be rejected")
+	_assert(t, server.RegisterName("Gate", gate) == nil, "register failed")
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	greet := func(service string) (string, error) {
+		var reply string
+		err := client.CallTimeout(service+".Greet", "minirpc", &reply, time.Second)
+		return reply, err
+	}
+	reply, err := greet("Hello")
+	_assert(t, err == nil && reply == "hello, minirpc", "call failed: %v, %q", err, reply)
+	reply, err = greet("Hi")
+	_assert(t, err == nil && reply == "hi, minirpc", "call failed: %v, %q", err, reply)
+
+	_assert(t, server.Replace("Hi", Greeter{"hey"}) == nil, "replace failed")
+	_assert(t, server.Replace("Missing", Greeter{"hey"}) != nil, "replace unknown service should fail")
+	reply, err = greet("Hi")
+	_assert(t, err == nil && reply == "hey, minirpc", "call failed: %v, %q", err, reply)
+
+	_assert(t, server.Unregister("Hello") == nil, "unregister failed")
+	_, err = greet("Hello")
+	_assert(t, err != nil, "unregistered service should not be callable")
+
+	// 注销不影响正在处理的请求
+	var n int
+	call := client.Go("Gate.Wait", 1, &n, nil)
+	<-gate.entered
+	_assert(t, server.Unregister("Gate") == nil, "unregister failed")
+	err = client.CallTimeout("Gate.Wait", 2, &n, time.Second)
+	_assert(t, err != nil, "unregistered service should not be callable")
+	close(gate.release)
+	<-call.Done
+	_assert(t, call.Err == nil && n == 1, "in-flight call failed: %v", call.Err)
+}
+
+func TestServer_RegisterFunc(t *testing.T) {
+	t.Parallel()
+	server, addr := startTestServer(t)
+	add := func(args Args, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	}
+	mul := func(ctx context.Context, args Args, reply *int) error {
+		*reply = args.A * args.B
+		return ctx.Err()
+	}
+	_assert(t, server.RegisterFunc("Math.Add", add) == nil, "register func failed")
+	_assert(t, server.RegisterFunc("Math.Mul", mul) == nil, "register func failed")
+	_assert(t, server.RegisterFunc("Math.Add", add) != nil, "duplicate func should be rejected")
+	_assert(t, server.RegisterFunc("Math.Sub", func(args Args) error { return nil }) != nil,
+		"wrong signature should be rejected")
+	_assert(t, server.RegisterFunc("MathAdd", add) != nil, "ill-formed name should be rejected")
+	_ = server.Register(Foo{})
+	_assert(t, server.RegisterFunc("Foo.Add", add) != nil, "func should not join a struct service")
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var reply int
+	err = client.CallTimeout("Math.Add", Args{A: 2, B: 3}, &reply, time.Second)
+	_assert(t, err == nil && reply == 5, "call failed: %v", err)
+	err = client.CallTimeout("Math.Mul", Args{A: 2, B: 3}, &reply, time.Second)
+	_assert(t, err == nil && reply == 6, "call failed: %v", err)
+}
+
+func TestServer_WorkerPool(t *testing.T) {
+	t.Parallel()
+	gate := Gate{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	server, addr := startTestServer(t, WithWorkerPool(1, 1))
+	_ = server.Register(gate)
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// 第一个请求占用唯一的工作协程，第二个请求在队列中等待
+	var r1, r2, r3 int
+	call1 := client.Go("Gate.Wait", 1, &r1, nil)
+	<-gate.entered
+	call2 := client.Go("Gate.Wait", 2, &r2, nil)
+	for i := 0; server.PoolStats().Queued != 1; i++ {
+		_assert(t, i < 100, "request is not queued")
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = client.CallTimeout("Gate.Wait", 3, &r3, time.Second)
+	_assert(t, errors.Is(err, ErrOverloaded), "expect ErrOverloaded, got %v", err)
+	_assert(t, server.PoolStats().Rejected == 1, "expect 1 rejected, got %d", server.PoolStats().Rejected)
+
+	close(gate.release)
+	<-call1.Done
+	<-call2.Done
+	_assert(t, call1.Err == nil && r1 == 1, "call failed: %v", call1.Err)
+	_assert(t, call2.Err == nil && r2 == 2, "call failed: %v", call2.Err)
+}
+
+// 方法超时后仍然占用工作协程，直到真正返回
+func TestServer_WorkerPoolTimeout(t *testing.T) {
+	t.Parallel()
+	gate := Gate{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	server, addr := startTestServer(t, WithWorkerPool(1, 1))
+	_ = server.RegisterWithOptions(gate, MethodTimeout("Wait", 50*time.Millisecond))
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var r1, r2 int
+	err = client.CallTimeout("Gate.Wait", 1, &r1, time.Second)
+	_assert(t, errors.Is(err, ErrHandleTimeout), "expect ErrHandleTimeout, got %v", err)
+	<-gate.entered
+	call := client.Go("Gate.Wait", 2, &r2, nil)
+	select {
+	case <-gate.entered:
+		t.Fatal("second handler started while the first is still running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	_assert(t, server.PoolStats().Queued == 1, "expect 1 queued, got %d", server.PoolStats().Queued)
+	close(gate.release)
+	<-call.Done
+	_assert(t, call.Err == nil && r2 == 2, "call failed: %v", call.Err)
+}
+
+type Validator struct{}
+
+func (v Validator) Check(name string, reply *bool) error {
+	if name == "" {
+		st := &Status{Code: CodeInvalidArgument, Message: "name is required", Details: map[string]string{"field": "name"}}
+		return fmt.Errorf("validate: %w", st)
+	}
+	if name == "guest" {
+		return Errorf(CodeUnauthenticated, "guest is not allowed")
+	}
+	if name == "error" {
+		return errors.New("plain error")
+	}
+	if name == "internal" {
+		return Errorf(CodeInternal, "rpc: service method panicked")
+	}
+	if name == "slow" {
+		time.Sleep(200 * time.Millisecond)
+	}
+	*reply = true
+	return nil
+}
+
+func TestClient_Status(t *testing.T) {
+	t.Parallel()
+	server, addr := startTestServer(t)
+	_ = server.Register(Validator{})
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var ok bool
+	cases := []struct {
+		serviceMethod, args string
+		code                Code
+		msg                 string
+	}{
+		{"Validator.Check", "", CodeInvalidArgument, "validate: name is required"},
+		{"Validator.Check", "guest", CodeUnauthenticated, "guest is not allowed"},
+		{"Validator.Check", "error", CodeUnknown, "plain error"},
+		{"Validator.Missing", "minirpc", CodeNotFound, "rpc: can't find method Missing"},
+		{"Missing.Check", "minirpc", CodeNotFound, "rpc: can't find service Missing"},
+	}
+	for _, c := range cases {
+		err := client.CallTimeout(c.serviceMethod, c.args, &ok, time.Second)
+		var st *Status
+		_assert(t, errors.As(err, &st), "%s(%q): expect *Status, got %v", c.serviceMethod, c.args, err)
+		_assert(t, st.Code == c.code && st.Message == c.msg,
+			"%s(%q): expect %v %q, got %v %q", c.serviceMethod, c.args, c.code, c.msg, st.Code, st.Message)
+		_assert(t, errors.Is(err, &Status{Code: c.code}), "errors.Is should match by code")
+	}
+	err = client.CallTimeout("Validator.Check", "", &ok, time.Second)
+	var st *Status
+	_assert(t, errors.As(err, &st) && st.Details["field"] == "name", "details lost: %v", err)
+	err = client.CallTimeout("Validator.Check", "minirpc", &ok, time.Second)
+	_assert(t, err == nil && ok, "call failed: %v", err)
+	// 方法返回的错误即使 Message 与 ErrPanic 相同，也不会被判断为 ErrPanic
+	err = client.CallTimeout("Validator.Check", "internal", &ok, time.Second)
+	_assert(t, errors.Is(err, &Status{Code: CodeInternal}) && !errors.Is(err, ErrPanic), "unexpected error %v", err)
+	// 客户端的超时可以通过 errors.Is 判断
+	err = client.CallTimeout("Validator.Check", "slow", &ok, 50*time.Millisecond)
+	_assert(t, errors.Is(err, context.DeadlineExceeded), "expect context.DeadlineExceeded, got %v", err)
+}
+
+func TestClient_Cancel(t *testing.T) {
+	t.Parallel()
+	waiter := Waiter{done: make(chan error, 1)}
+	server, addr := startTestServer(t)
+	_ = server.Register(waiter)
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	var reply int
+	err = client.Call(ctx, "Waiter.Wait", 1, &reply)
+	_assert(t, err != nil, "call should be cancelled")
+	select {
+	case err = <-waiter.done:
+		_assert(t, err == context.Canceled, "expect context.Canceled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("handler is not cancelled by the client")
+	}
+	// 取消只影响对应的请求
+	var trace string
+	err = client.CallTimeout("Waiter.Trace", "trace:", &trace, time.Second)
+	_assert(t, err == nil && trace == "trace:", "call failed: %v", err)
+}
+
+// 对端不再读取时，阻塞的写入不影响调用按 ctx 返回
+func TestClient_BlockedWrite(t *testing.T) {
+	t.Parallel()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go func() {
+		var opt Option
+		_ = json.NewDecoder(peer).Decode(&opt)
+		_ = json.NewEncoder(peer).Encode(&opt)
+	}()
+	client, err := NewClient(conn, DefaultOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var reply int
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		err = client.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &reply, 200*time.Millisecond)
+		_assert(t, errors.Is(err, context.DeadlineExceeded), "expect context.DeadlineExceeded, got %v", err)
+		_assert(t, time.Since(start) < time.Second, "call blocked for %v", time.Since(start))
+	}
+}
+
+// 返回服务端处理请求时剩余的时间，可以经过 next 转发给下一跳
+type Hop struct {
+	next *Client
+}
+
+func (h Hop) Budget(ctx context.Context, hops int, reply *time.Duration) error {
+	if hops > 0 && h.next != nil {
+		return h.next.Call(ctx, "Hop.Budget", hops-1, reply)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("no deadline")
+	}
+	*reply = time.Until(deadline)
+	return nil
+}
+
+func TestClient_Deadline(t *testing.T) {
+	t.Parallel()
+	start := func(h Hop) (*Server, string) {
+		server, addr := startTestServer(t)
+		_ = server.Register(h)
+		return server, addr
+	}
+	serverB, addrB := start(Hop{})
+	clientB, err := DialTCP("tcp", addrB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientB.Close()
+	_, addrA := start(Hop{next: clientB})
+	clientA, err := DialTCP("tcp", addrA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientA.Close()
+
+	// 经过 A 转发到 B，B 看到的剩余时间不会超过客户端的截止时间
+	var budget time.Duration
+	err = clientA.CallTimeout("Hop.Budget", 1, &budget, 500*time.Millisecond)
+	_assert(t, err == nil, "call failed: %v", err)
+	_assert(t, budget > 0 && budget < 500*time.Millisecond, "unexpected budget: %v", budget)
+
+	// 已经过期的请求在服务端不会被执行
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	err = clientB.Call(ctx, "Hop.Budget", 0, &budget)
+	_assert(t, err != nil, "expired call should fail")
+	err = clientB.CallTimeout("Hop.Budget", 0, &budget, time.Second)
+	_assert(t, err == nil, "call failed: %v", err)
+	_, mtype, _ := serverB.findService("Hop.Budget")
+	_assert(t, mtype.NumCalls() == 2, "expired request should not be handled, got %d calls", mtype.NumCalls())
+}
+
+func TestReconnectingClient(t *testing.T) {
+	t.Parallel()
+	serve := func(addr string) (*Server, string) {
+		server := NewServer()
+		_ = server.Register(Foo{})
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Accept(listener)
+		return server, listener.Addr().String()
+	}
+	server, addr := serve("127.0.0.1:0")
+
+	states := make(chan ConnState, 16)
+	rc, err := NewReconnectingClient("tcp://"+addr, nil,
+		WithWaitForReady(),
+		WithBackoff(10*time.Millisecond, 50*time.Millisecond),
+		WithStateChange(func(s ConnState) {
+			select {
+			case states <- s:
+			default:
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var reply int
+	err = rc.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &reply, time.Second)
+	_assert(t, err == nil && reply == 3, "call failed: %v", err)
+
+	// 服务器重启后自动重连
+	_ = server.Close()
+	for s := range states {
+		if s == StateDisconnected {
+			break
+		}
+	}
+	server, _ = serve(addr)
+	defer server.Close()
+	err = rc.CallTimeout("Foo.Sum", Args{A: 2, B: 3}, &reply, 2*time.Second)
+	_assert(t, err == nil && reply == 5, "call after reconnect failed: %v", err)
+	_assert(t, rc.State() == StateReady, "expect Ready, got %v", rc.State())
+
+	t.Run("fail fast", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 没有服务器的地址
+		dead := listener.Addr().String()
+		listener.Close()
+		rc, err := NewReconnectingClient("tcp://"+dead, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		err = rc.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &reply, time.Second)
+		_assert(t, errors.Is(err, ErrNotConnected), "expect ErrNotConnected, got %v", err)
+	})
+}
+
+type Flaky struct {
+	// 每个方法在成功之前失败的次数
+	failures int32
+	calls    *int32
+}
+
+func (f Flaky) Get(args int, reply *int) error {
+	if atomic.AddInt32(f.calls, 1) <= f.failures {
+		return Errorf(CodeUnavailable, "try again")
+	}
+	*reply = args
+	return nil
+}
+
+func (f Flaky) Put(args int, reply *int) error {
+	return f.Get(args, reply)
+}
+
+func TestClient_Retry(t *testing.T) {
+	t.Parallel()
+	var calls int32
+	server, addr := startTestServer(t)
+	err := server.RegisterWithOptions(Flaky{failures: 2, calls: &calls}, MethodIdempotent("Get"))
+	_assert(t, err == nil, "register failed: %v", err)
+
+	dial := func(policy *RetryPolicy) *Client {
+		client, err := DialTCP("tcp", addr, &Option{
+			MagicNumber: MagicNumber,
+			CodecType:   DefaultCodecType,
+			RetryPolicy: policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	policy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	client := dial(policy)
+	defer client.Close()
+	_assert(t, client.Idempotent("Flaky.Get"), "server should advertise Flaky.Get as idempotent")
+	_assert(t, !client.Idempotent("Flaky.Put"), "Flaky.Put should not be idempotent")
+
+	t.Run("backoff", func(t *testing.T) {
+		// 没有设置 MaxBackoff 时不限制等待的时间
+		p := &RetryPolicy{InitialBackoff: 100 * time.Millisecond}
+		for attempt, upper := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+			d := p.Backoff(attempt + 1)
+			_assert(t, d >= upper/2 && d <= upper, "attempt %d: expect backoff in [%v, %v], got %v", attempt+1, upper/2, upper, d)
+		}
+		p.MaxBackoff = 150 * time.Millisecond
+		d := p.Backoff(3)
+		_assert(t, d >= 75*time.Millisecond && d <= 150*time.Millisecond, "expect backoff capped at 150ms, got %v", d)
+	})
+	t.Run("idempotent", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		var reply int
+		err := client.CallTimeout("Flaky.Get", 1, &reply, time.Second)
+		_assert(t, err == nil && reply == 1, "call failed: %v", err)
+		_assert(t, atomic.LoadInt32(&calls) == 3, "expect 3 attempts, got %d", calls)
+	})
+	t.Run("not idempotent", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		var reply int
+		err := client.CallTimeout("Flaky.Put", 1, &reply, time.Second)
+		_assert(t, errors.Is(err, &Status{Code: CodeUnavailable}), "expect CodeUnavailable, got %v", err)
+		_assert(t, atomic.LoadInt32(&calls) == 1, "expect 1 attempt, got %d", calls)
+	})
+	t.Run("declared by client", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		client := dial(&RetryPolicy{MaxAttempts: 3, IdempotentMethods: []string{"Flaky.Put"}})
+		defer client.Close()
+		var reply int
+		err := client.CallTimeout("Flaky.Put", 2, &reply, time.Second)
+		_assert(t, err == nil && reply == 2, "call failed: %v", err)
+	})
+	t.Run("max attempts", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		client := dial(&RetryPolicy{MaxAttempts: 2})
+		defer client.Close()
+		var reply int
+		err := client.CallTimeout("Flaky.Get", 3, &reply, time.Second)
+		_assert(t, errors.Is(err, &Status{Code: CodeUnavailable}), "expect CodeUnavailable, got %v", err)
+		_assert(t, atomic.LoadInt32(&calls) == 2, "expect 2 attempts, got %d", calls)
+	})
+}
+
+func TestClient_Interceptors(t *testing.T) {
+	t.Parallel()
+	var trace []string
+	var mu sync.Mutex
+	// 同一个拦截器同时用于服务端和客户端
+	record := func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error {
+		err := next(ctx, serviceMethod, args, reply)
+		mu.Lock()
+		trace = append(trace, fmt.Sprintf("%s:%v", serviceMethod, err == nil))
+		mu.Unlock()
+		return err
+	}
+	auth := func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error {
+		if md, _ := MetadataFromContext(ctx); md["token"] != "secret" {
+			return Errorf(CodeUnauthenticated, "unauthenticated")
+		}
+		return next(ctx, serviceMethod, args, reply)
+	}
+	server, addr := startTestServer(t)
+	server.Use(record, auth)
+	_ = server.Register(Foo{})
+
+	client, err := DialTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var sum int
+	err = client.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &sum, time.Second)
+	_assert(t, errors.Is(err, &Status{Code: CodeUnauthenticated}), "expect CodeUnauthenticated, got %v", err)
+
+	client.Use(record, func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error {
+		return next(WithMetadata(ctx, Metadata{"token": "secret"}), serviceMethod, args, reply)
+	}, func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error {
+		// 在客户端模拟一个服务端不存在的方法
+		if serviceMethod == "Foo.Mock" {
+			*reply.(*int) = 42
+			return nil
+		}
+		return next(ctx, serviceMethod, args, reply)
+	})
+	err = client.CallTimeout("Foo.Sum", Args{A: 1, B: 2}, &sum, time.Second)
+	_assert(t, err == nil && sum == 3, "call failed: %v", err)
+	call := <-client.Go("Foo.Sum", Args{A: 2, B: 3}, &sum, nil).Done
+	_assert(t, call.Err == nil && sum == 5, "call failed: %v", call.Err)
+	var mock int
+	err = client.CallTimeout("Foo.Mock", Args{}, &mock, time.Second)
+	_assert(t, err == nil && mock == 42, "call failed: %v", err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 服务端的记录总是先于客户端
+	expect := []string{
+		"Foo.Sum:false",
+		"Foo.Sum:true", "Foo.Sum:true",
+		"Foo.Sum:true", "Foo.Sum:true",
+		"Foo.Mock:true",
+	}
+	_assert(t, strings.Join(trace, ",") == strings.Join(expect, ","), "unexpected trace: %v", trace)
+}
@@ -2,13 +2,16 @@ package codec
 
 import (
 	"io"
+	"sync"
+	"time"
 )
 
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json" // TODO
+	GobType     Type = "application/gob"
+	JsonType    Type = "application/json"
+	MsgpackType Type = "application/msgpack"
 )
 
 type Header struct {
@@ -17,6 +20,15 @@ type Header struct {
 	// 远程调用的序号，用来区分不同的调用
 	Seq   uint64
 	Error string
+	// 错误码，对应 minirpc.Code，0 表示没有指明类别的错误
+	Code uint32
+	// 错误的附加详情
+	Details map[string]string
+	// 随请求或响应传输的键值对，如认证信息、链路追踪 ID 等
+	Metadata map[string]string
+	// 请求剩余的处理时间，0 表示没有截止时间，负数表示发送时已经过期
+	// 使用相对时间，不受双方时钟偏差的影响
+	Timeout time.Duration
 }
 
 // 编码器接口，用来编码报文
@@ -30,13 +42,49 @@ type Codec interface {
 	Write(*Header, interface{}) error
 }
 
-// 编码器的构造函数类型
-type NewCodecFunc func(io.ReadWriteCloser) Codec
+// 编码器的构造函数类型，cfg 为 nil 时使用默认配置
+type NewCodecFunc func(conn io.ReadWriteCloser, cfg *Config) Codec
 
-var NewCodecFuncMap map[Type]NewCodecFunc
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[Type]NewCodecFunc)
+	// 按注册顺序记录编码类型，作为默认的优先级
+	codecTypes []Type
+)
+
+// 注册一种编码方式，类型为空、构造函数为 nil 或者重复注册时会 panic
+func Register(typ Type, f NewCodecFunc) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if typ == "" || f == nil {
+		panic("rpc codec: Register codec with empty type or nil constructor")
+	}
+	if _, dup := codecs[typ]; dup {
+		panic("rpc codec: Register called twice for codec " + string(typ))
+	}
+	codecs[typ] = f
+	codecTypes = append(codecTypes, typ)
+}
+
+// 查找编码方式对应的构造函数
+func Lookup(typ Type) (NewCodecFunc, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	f, ok := codecs[typ]
+	return f, ok
+}
+
+// 返回所有已注册的编码类型，按注册顺序排列
+func Types() []Type {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	types := make([]Type, len(codecTypes))
+	copy(types, codecTypes)
+	return types
+}
 
 func init() {
-	NewCodecFuncMap = make(map[Type]NewCodecFunc)
-	NewCodecFuncMap[GobType] = NewGobCodec
-	// NewCodecFuncMap[JsonType] = NewJsonCodec
+	Register(GobType, NewGobCodec)
+	Register(JsonType, NewJsonCodec)
+	Register(MsgpackType, NewMsgpackCodec)
 }
@@ -0,0 +1,175 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// 压缩算法，在握手时由客户端提出，服务端确认
+type Compression string
+
+const (
+	CompressionNone  Compression = ""
+	CompressionGzip  Compression = "gzip"
+	CompressionFlate Compression = "flate"
+	CompressionZlib  Compression = "zlib"
+)
+
+// 默认只压缩超过 1 KiB 的 body
+const DefaultCompressThreshold = 1 << 10
+
+// 判断是否为支持的压缩算法
+func (c Compression) Valid() bool {
+	switch c {
+	case CompressionNone, CompressionGzip, CompressionFlate, CompressionZlib:
+		return true
+	}
+	return false
+}
+
+// 启用压缩后，body 帧的第一个字节表示内容是否被压缩
+const (
+	bodyRaw        byte = 0
+	bodyCompressed byte = 1
+)
+
+// 可以通过 Reset 复用的压缩器，gzip、flate 和 zlib 的 Writer 都满足此接口
+type compressor interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// 每个连接各自持有的压缩状态，压缩器在多次写入之间复用
+type compression struct {
+	algorithm Compression
+	threshold int
+	zw        compressor
+	zr        io.ReadCloser
+	buf       bytes.Buffer
+}
+
+func newCompression(cfg *Config) *compression {
+	if cfg == nil || cfg.Compression == CompressionNone {
+		return nil
+	}
+	c := &compression{
+		algorithm: cfg.Compression,
+		threshold: cfg.CompressThreshold,
+	}
+	if c.threshold == 0 {
+		c.threshold = DefaultCompressThreshold
+	}
+	return c
+}
+
+// 压缩 raw，返回的切片在下一次调用之前有效
+func (c *compression) compress(raw []byte) ([]byte, error) {
+	c.buf.Reset()
+	if c.zw == nil {
+		var err error
+		switch c.algorithm {
+		case CompressionGzip:
+			c.zw = gzip.NewWriter(&c.buf)
+		case CompressionFlate:
+			c.zw, err = flate.NewWriter(&c.buf, flate.DefaultCompression)
+		case CompressionZlib:
+			c.zw = zlib.NewWriter(&c.buf)
+		default:
+			err = fmt.Errorf("rpc codec: unsupported compression %q", c.algorithm)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c.zw.Reset(&c.buf)
+	}
+	if _, err := c.zw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := c.zw.Close(); err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+// 解压 raw，解压后的长度不能超过 maxSize
+func (c *compression) decompress(raw []byte, maxSize uint32) ([]byte, error) {
+	src := bytes.NewReader(raw)
+	var err error
+	switch c.algorithm {
+	case CompressionGzip:
+		if c.zr == nil {
+			c.zr, err = gzip.NewReader(src)
+		} else {
+			err = c.zr.(*gzip.Reader).Reset(src)
+		}
+	case CompressionFlate:
+		if c.zr == nil {
+			c.zr = flate.NewReader(src)
+		} else {
+			err = c.zr.(flate.Resetter).Reset(src, nil)
+		}
+	case CompressionZlib:
+		if c.zr == nil {
+			c.zr, err = zlib.NewReader(src)
+		} else {
+			err = c.zr.(zlib.Resetter).Reset(src, nil)
+		}
+	default:
+		err = fmt.Errorf("rpc codec: unsupported compression %q", c.algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 多读一个字节，用来判断解压后的内容是否超过限制
+	out, err := io.ReadAll(io.LimitReader(c.zr, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(out)) > uint64(maxSize) {
+		return nil, fmt.Errorf("%w: decompressed body exceeds limit %d", ErrFrameTooLarge, maxSize)
+	}
+	return out, nil
+}
+
+// 读取一个 body 帧，启用压缩时按第一个字节解压
+func (f *framer) readBodyFrame() ([]byte, error) {
+	raw, err := f.readFrame()
+	if err != nil || f.compression == nil {
+		return raw, err
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%w: missing compression flag", ErrTruncated)
+	}
+	switch raw[0] {
+	case bodyRaw:
+		return raw[1:], nil
+	case bodyCompressed:
+		return f.compression.decompress(raw[1:], f.maxSize)
+	default:
+		return nil, fmt.Errorf("rpc codec: unknown compression flag %d", raw[0])
+	}
+}
+
+// 写入一个 body 帧，启用压缩时只压缩超过阈值且压缩后更小的内容
+func (f *framer) writeBodyFrame(raw []byte) error {
+	c := f.compression
+	if c == nil {
+		return f.writeFrame(raw)
+	}
+	flag := bodyRaw
+	if len(raw) > c.threshold {
+		compressed, err := c.compress(raw)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(raw) {
+			flag, raw = bodyCompressed, compressed
+		}
+	}
+	return f.writeFrameWithFlag(flag, raw)
+}
@@ -0,0 +1,177 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// 单帧默认的最大长度
+const DefaultMaxFrameSize = 16 << 20
+
+var (
+	// 帧的长度超过了限制，帧的内容已被跳过，数据流仍然是对齐的
+	ErrFrameTooLarge = errors.New("rpc codec: frame too large")
+	// 帧的校验和不匹配，数据已经损坏
+	ErrChecksum = errors.New("rpc codec: frame checksum mismatch")
+	// 帧还没有读完连接就已经断开
+	ErrTruncated = errors.New("rpc codec: frame truncated")
+)
+
+// 编码器的配置，由握手时的 Option 决定
+type Config struct {
+	// 读取时单帧的最大长度，0 表示使用 DefaultMaxFrameSize
+	MaxFrameSize uint32
+	// 是否在每一帧的末尾附加 CRC32 校验和
+	Checksum bool
+	// body 使用的压缩算法，需要通信双方在握手时协商一致
+	Compression Compression
+	// 超过该长度的 body 才会被压缩，0 表示使用 DefaultCompressThreshold
+	CompressThreshold int
+}
+
+// 所有编码器共用的帧层
+// 每一帧的格式为：4 字节大端序的长度 + 内容 + 可选的 4 字节 CRC32 校验和
+type framer struct {
+	conn     io.ReadWriteCloser
+	r        *bufio.Reader
+	w        *bufio.Writer
+	maxSize  uint32
+	checksum bool
+	// 未启用压缩时为 nil
+	compression *compression
+	// 最近一次读取的帧所在的缓冲区，下一次读取时放回池中
+	rbuf *frameBuffer
+	// 读写长度和校验和时复用的缓冲区，避免每次都分配
+	rhead, whead [4]byte
+}
+
+func newFramer(conn io.ReadWriteCloser, cfg *Config) *framer {
+	f := &framer{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		maxSize: DefaultMaxFrameSize,
+	}
+	if cfg != nil {
+		if cfg.MaxFrameSize != 0 {
+			f.maxSize = cfg.MaxFrameSize
+		}
+		f.checksum = cfg.Checksum
+	}
+	f.compression = newCompression(cfg)
+	return f
+}
+
+// 读取一帧的内容，返回的切片在下一次读取之前有效
+// 连接在帧的边界上正常关闭时返回 io.EOF
+func (f *framer) readFrame() ([]byte, error) {
+	if f.rbuf != nil {
+		putFrameBuffer(f.rbuf)
+		f.rbuf = nil
+	}
+	head := f.rhead[:]
+	if _, err := io.ReadFull(f.r, head); err != nil {
+		return nil, truncated(err, false)
+	}
+	length := binary.BigEndian.Uint32(head)
+	if length > f.maxSize {
+		// 跳过整帧，使下一帧依然可以正常读取
+		skip := int64(length)
+		if f.checksum {
+			skip += 4
+		}
+		if _, err := io.CopyN(io.Discard, f.r, skip); err != nil {
+			return nil, truncated(err, true)
+		}
+		return nil, fmt.Errorf("%w: %d bytes exceeds limit %d", ErrFrameTooLarge, length, f.maxSize)
+	}
+	f.rbuf = getFrameBuffer(int(length))
+	raw := f.rbuf.b
+	if _, err := io.ReadFull(f.r, raw); err != nil {
+		return nil, truncated(err, true)
+	}
+	if f.checksum {
+		if _, err := io.ReadFull(f.r, head); err != nil {
+			return nil, truncated(err, true)
+		}
+		if binary.BigEndian.Uint32(head) != crc32.ChecksumIEEE(raw) {
+			return nil, ErrChecksum
+		}
+	}
+	return raw, nil
+}
+
+// 写入一帧，需要调用 flush 才会真正发送
+func (f *framer) writeFrame(raw []byte) error {
+	return f.writeParts(nil, raw)
+}
+
+// 写入一个以 flag 开头的帧，避免为了拼接而复制 raw
+func (f *framer) writeFrameWithFlag(flag byte, raw []byte) error {
+	return f.writeParts([]byte{flag}, raw)
+}
+
+// 将 prefix 和 raw 拼接为一帧写入
+func (f *framer) writeParts(prefix, raw []byte) error {
+	length := uint64(len(prefix)) + uint64(len(raw))
+	if length > math.MaxUint32 {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+	head := f.whead[:]
+	binary.BigEndian.PutUint32(head, uint32(length))
+	if _, err := f.w.Write(head); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(prefix); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(raw); err != nil {
+		return err
+	}
+	if f.checksum {
+		sum := crc32.Update(crc32.ChecksumIEEE(prefix), crc32.IEEETable, raw)
+		binary.BigEndian.PutUint32(head, sum)
+		if _, err := f.w.Write(head); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *framer) flush() error {
+	return f.w.Flush()
+}
+
+func (f *framer) close() error {
+	return f.conn.Close()
+}
+
+// 帧读到一半时连接断开，转换为 ErrTruncated
+// 在帧开始之前断开的 io.EOF 表示连接正常关闭，原样返回
+func truncated(err error, started bool) error {
+	if err == io.ErrUnexpectedEOF || (started && err == io.EOF) {
+		return fmt.Errorf("%w: %v", ErrTruncated, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// 判断读取错误之后数据流是否仍然对齐，即是否可以继续读取下一帧
+func Recoverable(err error) bool {
+	var u unrecoverableError
+	return errors.Is(err, ErrFrameTooLarge) && !errors.As(err, &u)
+}
+
+// 帧虽然被跳过，但编码器依赖其中的内容，之后的数据已经无法解码
+// 包装后的错误仍然可以通过 errors.Is 匹配原来的错误
+type unrecoverableError struct {
+	error
+}
+
+func (e unrecoverableError) Unwrap() error {
+	return e.error
+}
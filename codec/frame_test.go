@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestFramer_MaxFrameSize(t *testing.T) {
+	conn := new(loopConn)
+	f := newFramer(conn, &Config{MaxFrameSize: 8, Checksum: true})
+	_ = f.writeFrame(make([]byte, 16))
+	_ = f.writeFrame([]byte("ok"))
+	_ = f.flush()
+
+	if _, err := f.readFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expect ErrFrameTooLarge, got %v", err)
+	}
+	// 超长的帧被跳过之后，下一帧依然可以读取
+	raw, err := f.readFrame()
+	if err != nil || string(raw) != "ok" {
+		t.Fatalf("expect next frame, got %q, %v", raw, err)
+	}
+}
+
+func TestFramer_Checksum(t *testing.T) {
+	conn := new(loopConn)
+	f := newFramer(conn, &Config{Checksum: true})
+	_ = f.writeFrame([]byte("hello"))
+	_ = f.flush()
+	// 篡改帧的内容
+	conn.Bytes()[4] ^= 0xff
+	if _, err := f.readFrame(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("expect ErrChecksum, got %v", err)
+	}
+}
+
+func TestFramer_Truncated(t *testing.T) {
+	conn := new(loopConn)
+	f := newFramer(conn, nil)
+	_ = f.writeFrame([]byte("hello"))
+	_ = f.flush()
+	conn.Truncate(conn.Len() - 1)
+	if _, err := f.readFrame(); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expect ErrTruncated, got %v", err)
+	}
+}
+
+func TestFramer_Compression(t *testing.T) {
+	conn := new(loopConn)
+	f := newFramer(conn, &Config{
+		MaxFrameSize: 1 << 10,
+		Compression:  CompressionGzip,
+	})
+	small := []byte("small")
+	large := bytes.Repeat([]byte("minirpc"), 100)
+	bomb := make([]byte, 1<<20)
+	for _, raw := range [][]byte{small, large, bomb, small} {
+		if err := f.writeBodyFrame(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = f.flush()
+	expectFrame := func(expect []byte) {
+		raw, err := f.readBodyFrame()
+		if err != nil || !bytes.Equal(raw, expect) {
+			t.Fatalf("unexpected frame: %d bytes, %v", len(raw), err)
+		}
+	}
+	expectFrame(small)
+	expectFrame(large)
+	// 压缩后的 bomb 很小，但是解压后超过了帧的长度限制，只影响当前帧
+	if _, err := f.readBodyFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expect ErrFrameTooLarge, got %v", err)
+	}
+	expectFrame(small)
+}
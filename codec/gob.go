@@ -1,88 +1,112 @@
 package codec
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"io"
 
 	"github.com/sirupsen/logrus"
 )
 
+// GobCodec 使用 gob 编码报文，header 和 body 各自作为一帧发送
+// 编码器和解码器在整个连接的生命周期内复用，类型信息只在第一次出现时发送一次
 type GobCodec struct {
-	conn io.ReadWriteCloser
-	buf  *bufio.ReadWriter
-	dec  *gob.Decoder
-	enc  *gob.Encoder
+	frame *framer
+	// 编码器先写入 encBuf，再由 Write 按帧发送
+	encBuf *bytes.Buffer
+	enc    *gob.Encoder
+	// 每读取一帧就放入 decBuf，再交给解码器解码
+	decBuf *bytes.Buffer
+	dec    *gob.Decoder
 }
 
-func NewGobCodec(conn io.ReadWriteCloser) Codec {
-	writeBuf := bufio.NewWriter(conn)
-	readBuf := bufio.NewReader(conn)
-	buf := bufio.NewReadWriter(readBuf, writeBuf)
+func NewGobCodec(conn io.ReadWriteCloser, cfg *Config) Codec {
+	encBuf := new(bytes.Buffer)
+	decBuf := new(bytes.Buffer)
 	return &GobCodec{
-		conn: conn,
-		buf:  buf,
-		dec:  gob.NewDecoder(buf),
-		enc:  gob.NewEncoder(buf),
+		frame:  newFramer(conn, cfg),
+		encBuf: encBuf,
+		enc:    gob.NewEncoder(encBuf),
+		decBuf: decBuf,
+		// bytes.Buffer 实现了 io.ByteReader，解码器不会预读超出当前帧的数据
+		dec: gob.NewDecoder(decBuf),
 	}
 }
 
+// 读取一帧并交给解码器，v 为 nil 时解码后丢弃
+// 即使丢弃 body，也必须经过解码器，否则会错过其中携带的类型信息
+func (c *GobCodec) decode(v interface{}, body bool) error {
+	var raw []byte
+	var err error
+	if body {
+		raw, err = c.frame.readBodyFrame()
+	} else {
+		raw, err = c.frame.readFrame()
+	}
+	if err != nil {
+		// 被跳过的帧可能带有之后的消息依赖的类型信息，连接无法继续使用
+		if errors.Is(err, ErrFrameTooLarge) {
+			err = unrecoverableError{err}
+		}
+		return err
+	}
+	c.decBuf.Reset()
+	c.decBuf.Write(raw)
+	return c.dec.Decode(v)
+}
+
+// 编码 v 并作为一帧写入缓冲区，body 帧可能会被压缩
+func (c *GobCodec) encode(v interface{}, body bool) error {
+	c.encBuf.Reset()
+	if err := c.enc.Encode(v); err != nil {
+		return err
+	}
+	if body {
+		return c.frame.writeBodyFrame(c.encBuf.Bytes())
+	}
+	return c.frame.writeFrame(c.encBuf.Bytes())
+}
+
 func (c *GobCodec) ReadHeader(h *Header) error {
-	var length uint32
-	binary.Read(c.buf, binary.BigEndian, &length)
-	raw := make([]byte, length)
-	c.buf.Read(raw)
-	buf := bytes.NewBuffer(raw)
-	return gob.NewDecoder(buf).Decode(h)
+	return c.decode(h, false)
 }
 
 func (c *GobCodec) ReadBody(body interface{}) error {
-	var length uint32
-	binary.Read(c.buf, binary.BigEndian, &length)
-	raw := make([]byte, length)
-	c.buf.Read(raw)
-	buf := bytes.NewBuffer(raw)
-	// return c.dec.Decode(h)
-	return gob.NewDecoder(buf).Decode(body)
-	// return c.dec.Decode(body)
+	// 依然需要解码并丢弃，以免错过 body 中的类型信息
+	if _, ok := body.(*RawMessage); ok {
+		if err := c.decode(nil, true); err != nil {
+			return err
+		}
+		return ErrRawMessageNotSupported
+	}
+	return c.decode(body, true)
 }
 
 func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
+	// 在写入任何数据之前拒绝，连接依然可用
+	if _, ok := rawBytes(body); ok {
+		return ErrRawMessageNotSupported
+	}
 	defer func() {
-		_ = c.buf.Flush()
+		if err == nil {
+			err = c.frame.flush()
+		}
 		if err != nil {
 			_ = c.Close()
 		}
 	}()
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(h); err != nil {
+	if err := c.encode(h, false); err != nil {
 		logrus.Error("rpc codec: gob error encoding header:", err)
 		return err
 	}
-	binary.Write(c.buf, binary.BigEndian, uint32(buf.Len()))
-	c.buf.Write(buf.Bytes())
-
-	buf.Reset()
-	if err := gob.NewEncoder(buf).Encode(body); err != nil {
-		logrus.Error("rpc codec: gob error encoding header:", err)
+	if err := c.encode(body, true); err != nil {
+		logrus.Error("rpc codec: gob error encoding body:", err)
 		return err
 	}
-	binary.Write(c.buf, binary.BigEndian, uint32(buf.Len()))
-	c.buf.Write(buf.Bytes())
-
-	// if err := c.enc.Encode(h); err != nil {
-	// 	logrus.Error("rpc codec: gob error encoding header:", err)
-	// 	return err
-	// }
-	// if err := c.enc.Encode(body); err != nil {
-	// 	logrus.Error("rpc codec: gob error encoding body:", err)
-	// 	return err
-	// }
 	return nil
 }
 
 func (c *GobCodec) Close() error {
-	return c.conn.Close()
+	return c.frame.close()
 }
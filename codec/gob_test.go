@@ -0,0 +1,192 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+)
+
+// 在内存中回环的连接，写入的数据可以被再次读出，并统计写入的字节数
+type loopConn struct {
+	bytes.Buffer
+	written int
+}
+
+func (c *loopConn) Write(p []byte) (int, error) {
+	c.written += len(p)
+	return c.Buffer.Write(p)
+}
+
+func (c *loopConn) Close() error { return nil }
+
+type benchArgs struct {
+	A, B int
+}
+
+// 旧的实现：每一帧都新建编码器和解码器，类型信息随每一帧重复发送，仅用于基准对比
+type perMessageGobCodec struct {
+	frame *framer
+}
+
+func (c *perMessageGobCodec) decode(v interface{}) error {
+	raw, err := c.frame.readFrame()
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewBuffer(raw)).Decode(v)
+}
+
+func (c *perMessageGobCodec) encode(v interface{}) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	return c.frame.writeFrame(buf.Bytes())
+}
+
+func (c *perMessageGobCodec) ReadHeader(h *Header) error   { return c.decode(h) }
+func (c *perMessageGobCodec) ReadBody(v interface{}) error { return c.decode(v) }
+func (c *perMessageGobCodec) Close() error                 { return c.frame.close() }
+
+func (c *perMessageGobCodec) Write(h *Header, body interface{}) error {
+	if err := c.encode(h); err != nil {
+		return err
+	}
+	if err := c.encode(body); err != nil {
+		return err
+	}
+	return c.frame.flush()
+}
+
+func TestGobCodec_Stream(t *testing.T) {
+	conn := new(loopConn)
+	cc := NewGobCodec(conn, nil)
+	for i := 0; i < 3; i++ {
+		h := &Header{ServiceMethod: "Foo.Sum", Seq: uint64(i)}
+		if err := cc.Write(h, &benchArgs{i, i * i}); err != nil {
+			t.Fatal(err)
+		}
+		// 第一次写入包含类型信息，之后的写入只包含数据
+		if i == 0 {
+			conn.written = 0
+		}
+	}
+	perMessageConn := new(loopConn)
+	perMessage := &perMessageGobCodec{frame: newFramer(perMessageConn, nil)}
+	if err := perMessage.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, &benchArgs{2, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if conn.written/2 >= perMessageConn.written {
+		t.Fatalf("stream codec should send less bytes: %d vs %d",
+			conn.written/2, perMessageConn.written)
+	}
+
+	for i := 0; i < 3; i++ {
+		var h Header
+		if err := cc.ReadHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Seq != uint64(i) {
+			t.Fatalf("expect seq %d, got %d", i, h.Seq)
+		}
+		// 丢弃第二个 body，之后的 body 依然可以正常解码
+		if i == 1 {
+			if err := cc.ReadBody(nil); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var args benchArgs
+		if err := cc.ReadBody(&args); err != nil {
+			t.Fatal(err)
+		}
+		if args.A != i || args.B != i*i {
+			t.Fatalf("unexpected body %+v", args)
+		}
+	}
+}
+
+// 统计每次调用（一次写入和一次读取）的字节数和内存分配
+func benchmarkCodec(b *testing.B, conn *loopConn, cc Codec) {
+	h := &Header{ServiceMethod: "Foo.Sum"}
+	args := &benchArgs{1, 2}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Seq = uint64(i)
+		if err := cc.Write(h, args); err != nil {
+			b.Fatal(err)
+		}
+		var rh Header
+		var ra benchArgs
+		if err := cc.ReadHeader(&rh); err != nil {
+			b.Fatal(err)
+		}
+		if err := cc.ReadBody(&ra); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(conn.written)/float64(b.N), "bytes/call")
+}
+
+func BenchmarkGobCodec_Stream(b *testing.B) {
+	conn := new(loopConn)
+	benchmarkCodec(b, conn, NewGobCodec(conn, nil))
+}
+
+func BenchmarkGobCodec_PerMessage(b *testing.B) {
+	conn := new(loopConn)
+	benchmarkCodec(b, conn, &perMessageGobCodec{frame: newFramer(conn, nil)})
+}
+
+func TestGobCodec_RawMessage(t *testing.T) {
+	conn := new(loopConn)
+	cc := NewGobCodec(conn, nil)
+	if err := cc.Write(&Header{Seq: 1}, RawMessage("raw")); !errors.Is(err, ErrRawMessageNotSupported) {
+		t.Fatalf("expect ErrRawMessageNotSupported, got %v", err)
+	}
+	// 被拒绝的写入不会影响连接
+	if err := cc.Write(&Header{Seq: 2}, &benchArgs{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	var h Header
+	var raw RawMessage
+	_ = cc.ReadHeader(&h)
+	if err := cc.ReadBody(&raw); !errors.Is(err, ErrRawMessageNotSupported) {
+		t.Fatalf("expect ErrRawMessageNotSupported, got %v", err)
+	}
+}
+
+// 超长的 body 被跳过后，同类型的后续消息缺少类型信息，连接不能再继续使用
+func TestGobCodec_FrameTooLarge(t *testing.T) {
+	type blob struct{ Data []byte }
+	conn := new(loopConn)
+	w := NewGobCodec(conn, nil)
+	if err := w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &blob{make([]byte, 1024)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, &blob{[]byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	r := NewGobCodec(conn, &Config{MaxFrameSize: 512})
+	var h Header
+	if err := r.ReadHeader(&h); err != nil {
+		t.Fatal(err)
+	}
+	var body blob
+	err := r.ReadBody(&body)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expect ErrFrameTooLarge, got %v", err)
+	}
+	if Recoverable(err) {
+		t.Fatal("gob stream should not be recoverable after skipping a frame")
+	}
+	// 第二条消息的类型信息随第一条被跳过了
+	if err := r.ReadHeader(&h); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReadBody(&body); err == nil {
+		t.Fatal("expect the following body to be undecodable")
+	}
+}
@@ -0,0 +1,85 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JsonCodec 使用 JSON 编码报文，header 和 body 各自作为一帧发送
+// 方便非 Go 语言的客户端和调试工具直接与服务端通信
+type JsonCodec struct {
+	frame *framer
+}
+
+func NewJsonCodec(conn io.ReadWriteCloser, cfg *Config) Codec {
+	return &JsonCodec{
+		frame: newFramer(conn, cfg),
+	}
+}
+
+func (c *JsonCodec) ReadHeader(h *Header) error {
+	raw, err := c.frame.readFrame()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, h)
+}
+
+// body 为 nil 时只读取并丢弃报文
+func (c *JsonCodec) ReadBody(body interface{}) error {
+	raw, err := c.frame.readBodyFrame()
+	if err != nil {
+		return err
+	}
+	if body == nil || setRaw(body, raw) {
+		return nil
+	}
+	return json.Unmarshal(raw, body)
+}
+
+func (c *JsonCodec) Write(h *Header, body interface{}) (err error) {
+	defer func() {
+		if err == nil {
+			err = c.frame.flush()
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	buf := getEncodeBuffer()
+	defer putEncodeBuffer(buf)
+	raw, err := encodeJSON(buf, h)
+	if err != nil {
+		logrus.Error("rpc codec: json error encoding header:", err)
+		return err
+	}
+	if err := c.frame.writeFrame(raw); err != nil {
+		return err
+	}
+
+	if b, ok := rawBytes(body); ok {
+		return c.frame.writeBodyFrame(b)
+	}
+	buf.Reset()
+	if raw, err = encodeJSON(buf, body); err != nil {
+		logrus.Error("rpc codec: json error encoding body:", err)
+		return err
+	}
+	return c.frame.writeBodyFrame(raw)
+}
+
+// 将 v 编码到 buf 中，与 json.Marshal 的结果相同，但不需要分配新的切片
+func encodeJSON(buf *bytes.Buffer, v interface{}) ([]byte, error) {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	// 去掉 Encoder 在末尾添加的换行符
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (c *JsonCodec) Close() error {
+	return c.frame.close()
+}
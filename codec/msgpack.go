@@ -0,0 +1,963 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MsgpackCodec 使用 MessagePack 编码报文，header 和 body 各自作为一帧发送
+// 结构体被编码为以字段名为键的 map，方便其他语言直接解析
+// 可以通过 `msgpack:"name,omitempty"` 标签修改字段名，"-" 表示忽略该字段
+type MsgpackCodec struct {
+	frame *framer
+}
+
+func NewMsgpackCodec(conn io.ReadWriteCloser, cfg *Config) Codec {
+	return &MsgpackCodec{
+		frame: newFramer(conn, cfg),
+	}
+}
+
+func (c *MsgpackCodec) ReadHeader(h *Header) error {
+	raw, err := c.frame.readFrame()
+	if err != nil {
+		return err
+	}
+	return msgpackUnmarshal(raw, h)
+}
+
+// body 为 nil 时只读取并丢弃报文
+func (c *MsgpackCodec) ReadBody(body interface{}) error {
+	raw, err := c.frame.readBodyFrame()
+	if err != nil {
+		return err
+	}
+	if body == nil || setRaw(body, raw) {
+		return nil
+	}
+	return msgpackUnmarshal(raw, body)
+}
+
+// 编码 v 并作为一帧写入缓冲区，body 帧可能会被压缩
+func (c *MsgpackCodec) encode(v interface{}, body bool) error {
+	buf := getEncodeBuffer()
+	defer putEncodeBuffer(buf)
+	if err := msgpackMarshal(buf, v); err != nil {
+		return err
+	}
+	if body {
+		return c.frame.writeBodyFrame(buf.Bytes())
+	}
+	return c.frame.writeFrame(buf.Bytes())
+}
+
+func (c *MsgpackCodec) Write(h *Header, body interface{}) (err error) {
+	defer func() {
+		if err == nil {
+			err = c.frame.flush()
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err := c.encode(h, false); err != nil {
+		logrus.Error("rpc codec: msgpack error encoding header:", err)
+		return err
+	}
+	if b, ok := rawBytes(body); ok {
+		return c.frame.writeBodyFrame(b)
+	}
+	if err := c.encode(body, true); err != nil {
+		logrus.Error("rpc codec: msgpack error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+func (c *MsgpackCodec) Close() error {
+	return c.frame.close()
+}
+
+// MessagePack 格式中各类型的首字节
+const (
+	mpNil     = 0xc0
+	mpFalse   = 0xc2
+	mpTrue    = 0xc3
+	mpBin8    = 0xc4
+	mpBin16   = 0xc5
+	mpBin32   = 0xc6
+	mpExt8    = 0xc7
+	mpExt16   = 0xc8
+	mpExt32   = 0xc9
+	mpFloat32 = 0xca
+	mpFloat64 = 0xcb
+	mpUint8   = 0xcc
+	mpUint16  = 0xcd
+	mpUint32  = 0xce
+	mpUint64  = 0xcf
+	mpInt8    = 0xd0
+	mpInt16   = 0xd1
+	mpInt32   = 0xd2
+	mpInt64   = 0xd3
+	mpFixExt1 = 0xd4
+	mpFixExt2 = 0xd5
+	mpFixExt4 = 0xd6
+	mpFixExt8 = 0xd7
+	mpFixExt  = 0xd8
+	mpStr8    = 0xd9
+	mpStr16   = 0xda
+	mpStr32   = 0xdb
+	mpArray16 = 0xdc
+	mpArray32 = 0xdd
+	mpMap16   = 0xde
+	mpMap32   = 0xdf
+)
+
+var errMsgpackShort = errors.New("rpc codec: msgpack data too short")
+
+// 解码时允许的最大嵌套层数，避免恶意构造的数据耗尽栈空间
+const mpMaxDepth = 10000
+
+var errMsgpackDepth = errors.New("rpc codec: msgpack data nested too deep")
+
+// 结构体中需要编码的字段
+type mpField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// 缓存每个结构体类型的字段列表，key 为 reflect.Type
+var mpFieldCache sync.Map
+
+func mpFields(t reflect.Type) []mpField {
+	if fields, ok := mpFieldCache.Load(t); ok {
+		return fields.([]mpField)
+	}
+	var fields []mpField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		// 忽略不可导出的字段
+		if sf.PkgPath != "" {
+			continue
+		}
+		field := mpField{name: sf.Name, index: i}
+		if tag, ok := sf.Tag.Lookup("msgpack"); ok {
+			if tag == "-" {
+				continue
+			}
+			opts := strings.Split(tag, ",")
+			if opts[0] != "" {
+				field.name = opts[0]
+			}
+			for _, opt := range opts[1:] {
+				if opt == "omitempty" {
+					field.omitEmpty = true
+				}
+			}
+		}
+		fields = append(fields, field)
+	}
+	mpFieldCache.Store(t, fields)
+	return fields
+}
+
+// 将 v 编码为 MessagePack 并追加到 buf 中
+func msgpackMarshal(buf *bytes.Buffer, v interface{}) error {
+	if v == nil {
+		buf.WriteByte(mpNil)
+		return nil
+	}
+	e := mpEncoder{buf: buf}
+	return e.encode(reflect.ValueOf(v))
+}
+
+type mpEncoder struct {
+	buf *bytes.Buffer
+}
+
+func (e *mpEncoder) encode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Invalid:
+		e.buf.WriteByte(mpNil)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf.WriteByte(mpNil)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf.WriteByte(mpTrue)
+		} else {
+			e.buf.WriteByte(mpFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Float32:
+		e.buf.WriteByte(mpFloat32)
+		e.writeBE(uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.buf.WriteByte(mpFloat64)
+		e.writeBE(math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		e.writeLen(v.Len(), 0xa0, 32, mpStr8, mpStr16, mpStr32)
+		e.buf.WriteString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf.WriteByte(mpNil)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeLen(v.Len(), 0, 0, mpBin8, mpBin16, mpBin32)
+			e.buf.Write(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeLen(v.Len(), 0, 0, mpBin8, mpBin16, mpBin32)
+			for i := 0; i < v.Len(); i++ {
+				e.buf.WriteByte(byte(v.Index(i).Uint()))
+			}
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf.WriteByte(mpNil)
+			return nil
+		}
+		e.writeLen(v.Len(), 0x80, 16, 0, mpMap16, mpMap32)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("rpc codec: msgpack unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (e *mpEncoder) encodeArray(v reflect.Value) error {
+	e.writeLen(v.Len(), 0x90, 16, 0, mpArray16, mpArray32)
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *mpEncoder) encodeStruct(v reflect.Value) error {
+	fields := mpFields(v.Type())
+	n := 0
+	for _, f := range fields {
+		if !f.omitEmpty || !mpIsEmpty(v.Field(f.index)) {
+			n++
+		}
+	}
+	e.writeLen(n, 0x80, 16, 0, mpMap16, mpMap32)
+	for _, f := range fields {
+		fv := v.Field(f.index)
+		if f.omitEmpty && mpIsEmpty(fv) {
+			continue
+		}
+		e.writeLen(len(f.name), 0xa0, 32, mpStr8, mpStr16, mpStr32)
+		e.buf.WriteString(f.name)
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mpIsEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// 使用能容纳 n 的最短格式编码整数
+func (e *mpEncoder) writeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.writeUint(uint64(n))
+	case n >= -32:
+		e.buf.WriteByte(byte(n))
+	case n >= math.MinInt8:
+		e.buf.WriteByte(mpInt8)
+		e.writeBE(uint64(n), 1)
+	case n >= math.MinInt16:
+		e.buf.WriteByte(mpInt16)
+		e.writeBE(uint64(n), 2)
+	case n >= math.MinInt32:
+		e.buf.WriteByte(mpInt32)
+		e.writeBE(uint64(n), 4)
+	default:
+		e.buf.WriteByte(mpInt64)
+		e.writeBE(uint64(n), 8)
+	}
+}
+
+func (e *mpEncoder) writeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		e.buf.WriteByte(mpUint8)
+		e.writeBE(n, 1)
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(mpUint16)
+		e.writeBE(n, 2)
+	case n <= math.MaxUint32:
+		e.buf.WriteByte(mpUint32)
+		e.writeBE(n, 4)
+	default:
+		e.buf.WriteByte(mpUint64)
+		e.writeBE(n, 8)
+	}
+}
+
+// 写入长度前缀，fixMax 为 0 表示该类型没有 fix 格式，c8 为 0 表示没有 8 位格式
+func (e *mpEncoder) writeLen(n int, fix byte, fixMax int, c8, c16, c32 byte) {
+	switch {
+	case n < fixMax:
+		e.buf.WriteByte(fix | byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		e.buf.WriteByte(c8)
+		e.writeBE(uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(c16)
+		e.writeBE(uint64(n), 2)
+	default:
+		e.buf.WriteByte(c32)
+		e.writeBE(uint64(n), 4)
+	}
+}
+
+// 以大端序写入 n 的低 size 个字节
+func (e *mpEncoder) writeBE(n uint64, size int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	e.buf.Write(b[8-size:])
+}
+
+// 将 MessagePack 数据解码到 v 中，v 必须是非 nil 的指针
+func msgpackUnmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("rpc codec: msgpack decode into non-pointer %T", v)
+	}
+	d := mpDecoder{data: data}
+	return d.decode(rv.Elem())
+}
+
+type mpDecoder struct {
+	data []byte
+	off  int
+	// 当前的嵌套层数
+	depth int
+}
+
+// 进入下一层嵌套，返回时需调用 leave
+func (d *mpDecoder) enter() error {
+	d.depth++
+	if d.depth > mpMaxDepth {
+		return errMsgpackDepth
+	}
+	return nil
+}
+
+func (d *mpDecoder) leave() {
+	d.depth--
+}
+
+// 检查数组或 map 的长度，每个元素至少占一个字节，超出剩余数据的长度一定是错误的
+// 在分配内存之前检查，避免对端用很大的长度前缀耗尽内存
+func (d *mpDecoder) checkLen(n, bytesPerElem int) error {
+	if n < 0 || n > (len(d.data)-d.off)/bytesPerElem {
+		return errMsgpackShort
+	}
+	return nil
+}
+
+func (d *mpDecoder) peek() (byte, error) {
+	if d.off >= len(d.data) {
+		return 0, errMsgpackShort
+	}
+	return d.data[d.off], nil
+}
+
+func (d *mpDecoder) readByte() (byte, error) {
+	c, err := d.peek()
+	if err == nil {
+		d.off++
+	}
+	return c, err
+}
+
+func (d *mpDecoder) readN(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.off < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+// 以大端序读取 size 个字节的无符号整数
+func (d *mpDecoder) readBE(size int) (uint64, error) {
+	b, err := d.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// 读取 8/16/32 位的长度前缀
+func (d *mpDecoder) readLen(size int) (int, error) {
+	n, err := d.readBE(size)
+	return int(n), err
+}
+
+// 读取整数，signed 表示结果在 i 中，否则在 u 中
+func (d *mpDecoder) readInt(c byte) (i int64, u uint64, signed bool, err error) {
+	switch {
+	case c <= 0x7f:
+		return 0, uint64(c), false, nil
+	case c >= 0xe0:
+		return int64(int8(c)), 0, true, nil
+	case c >= mpUint8 && c <= mpUint64:
+		u, err = d.readBE(1 << (c - mpUint8))
+		return 0, u, false, err
+	default:
+		size := 1 << (c - mpInt8)
+		u, err = d.readBE(size)
+		// 符号扩展
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, 0, true, err
+	}
+}
+
+func mpIsInt(c byte) bool {
+	return c <= 0x7f || c >= 0xe0 || (c >= mpUint8 && c <= mpInt64)
+}
+
+// 读取字符串或二进制数据的长度，c 不是这两种类型时 ok 为 false
+func (d *mpDecoder) readBytesLen(c byte) (n int, ok bool, err error) {
+	switch {
+	case c&0xe0 == 0xa0:
+		return int(c & 0x1f), true, nil
+	case c == mpStr8 || c == mpBin8:
+		n, err = d.readLen(1)
+	case c == mpStr16 || c == mpBin16:
+		n, err = d.readLen(2)
+	case c == mpStr32 || c == mpBin32:
+		n, err = d.readLen(4)
+	default:
+		return 0, false, nil
+	}
+	return n, true, err
+}
+
+// 读取数组的长度，c 不是数组类型时 ok 为 false
+func (d *mpDecoder) readArrayLen(c byte) (n int, ok bool, err error) {
+	switch {
+	case c&0xf0 == 0x90:
+		return int(c & 0x0f), true, nil
+	case c == mpArray16:
+		n, err = d.readLen(2)
+	case c == mpArray32:
+		n, err = d.readLen(4)
+	default:
+		return 0, false, nil
+	}
+	if err == nil {
+		err = d.checkLen(n, 1)
+	}
+	return n, true, err
+}
+
+// 读取 map 的长度，c 不是 map 类型时 ok 为 false
+func (d *mpDecoder) readMapLen(c byte) (n int, ok bool, err error) {
+	switch {
+	case c&0xf0 == 0x80:
+		return int(c & 0x0f), true, nil
+	case c == mpMap16:
+		n, err = d.readLen(2)
+	case c == mpMap32:
+		n, err = d.readLen(4)
+	default:
+		return 0, false, nil
+	}
+	if err == nil {
+		// 每个键值对至少占两个字节
+		err = d.checkLen(n, 2)
+	}
+	return n, true, err
+}
+
+// 读取扩展类型的数据长度，c 不是扩展类型时 ok 为 false
+func (d *mpDecoder) readExtLen(c byte) (n int, ok bool, err error) {
+	switch c {
+	case mpFixExt1, mpFixExt2, mpFixExt4, mpFixExt8, mpFixExt:
+		return 1 << (c - mpFixExt1), true, nil
+	case mpExt8:
+		n, err = d.readLen(1)
+	case mpExt16:
+		n, err = d.readLen(2)
+	case mpExt32:
+		n, err = d.readLen(4)
+	default:
+		return 0, false, nil
+	}
+	return n, true, err
+}
+
+// 解码一个值到 v 中，v 无效时跳过该值
+func (d *mpDecoder) decode(v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	if !v.IsValid() {
+		return d.skip()
+	}
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if c == mpNil {
+			d.off++
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("rpc codec: msgpack cannot decode into %s", v.Type())
+		}
+		x, err := d.decodeInterface()
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+		return nil
+	}
+
+	d.off++
+	if c == mpNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if c == mpTrue || c == mpFalse {
+		if v.Kind() != reflect.Bool {
+			return mpTypeError("bool", v)
+		}
+		v.SetBool(c == mpTrue)
+		return nil
+	}
+	if mpIsInt(c) {
+		i, u, signed, err := d.readInt(c)
+		if err != nil {
+			return err
+		}
+		return mpSetInt(v, i, u, signed)
+	}
+	if c == mpFloat32 || c == mpFloat64 {
+		var f float64
+		if c == mpFloat32 {
+			n, err := d.readBE(4)
+			if err != nil {
+				return err
+			}
+			f = float64(math.Float32frombits(uint32(n)))
+		} else {
+			n, err := d.readBE(8)
+			if err != nil {
+				return err
+			}
+			f = math.Float64frombits(n)
+		}
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return mpTypeError("float", v)
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	if n, ok, err := d.readBytesLen(c); ok {
+		if err != nil {
+			return err
+		}
+		b, err := d.readN(n)
+		if err != nil {
+			return err
+		}
+		return mpSetBytes(v, b)
+	}
+	if n, ok, err := d.readArrayLen(c); ok {
+		if err != nil {
+			return err
+		}
+		return d.decodeArray(v, n)
+	}
+	if n, ok, err := d.readMapLen(c); ok {
+		if err != nil {
+			return err
+		}
+		switch v.Kind() {
+		case reflect.Map:
+			return d.decodeMap(v, n)
+		case reflect.Struct:
+			return d.decodeStruct(v, n)
+		}
+		return mpTypeError("map", v)
+	}
+	return fmt.Errorf("rpc codec: msgpack unsupported type 0x%02x", c)
+}
+
+func mpTypeError(typ string, v reflect.Value) error {
+	return fmt.Errorf("rpc codec: msgpack cannot decode %s into %s", typ, v.Type())
+}
+
+func mpSetInt(v reflect.Value, i int64, u uint64, signed bool) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !signed {
+			if u > math.MaxInt64 {
+				return fmt.Errorf("rpc codec: msgpack %d overflows %s", u, v.Type())
+			}
+			i = int64(u)
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("rpc codec: msgpack %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if signed {
+			if i < 0 {
+				return fmt.Errorf("rpc codec: msgpack %d overflows %s", i, v.Type())
+			}
+			u = uint64(i)
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("rpc codec: msgpack %d overflows %s", u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		if signed {
+			v.SetFloat(float64(i))
+		} else {
+			v.SetFloat(float64(u))
+		}
+	default:
+		return mpTypeError("int", v)
+	}
+	return nil
+}
+
+// 字符串和二进制数据可以互相解码
+func mpSetBytes(v reflect.Value, b []byte) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(b))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(append([]byte(nil), b...))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		// 元素可能是自定义的 byte 类型，reflect.Copy 要求类型完全相同，因此逐个设置
+		for i := 0; i < v.Len(); i++ {
+			var c byte
+			if i < len(b) {
+				c = b[i]
+			}
+			v.Index(i).SetUint(uint64(c))
+		}
+	default:
+		return mpTypeError("string", v)
+	}
+	return nil
+}
+
+func (d *mpDecoder) decodeArray(v reflect.Value, n int) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() || v.Cap() < n {
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+		} else {
+			v.SetLen(n)
+		}
+	case reflect.Array:
+		// 多余的元素被丢弃，不足的元素置为零值
+		for i := n; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+	default:
+		return mpTypeError("array", v)
+	}
+	for i := 0; i < n; i++ {
+		var elem reflect.Value
+		if i < v.Len() {
+			elem = v.Index(i)
+		}
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *mpDecoder) decodeMap(v reflect.Value, n int) error {
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, n))
+	}
+	for i := 0; i < n; i++ {
+		key := reflect.New(t.Key()).Elem()
+		if err := d.decode(key); err != nil {
+			return err
+		}
+		if key.Kind() == reflect.Interface && !key.IsNil() && !key.Elem().Type().Comparable() {
+			return fmt.Errorf("rpc codec: msgpack unhashable map key %s", key.Elem().Type())
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+	}
+	return nil
+}
+
+// 按字段名解码结构体，先精确匹配再忽略大小写匹配，未知的字段会被跳过
+func (d *mpDecoder) decodeStruct(v reflect.Value, n int) error {
+	fields := mpFields(v.Type())
+	for i := 0; i < n; i++ {
+		var name string
+		if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+			return err
+		}
+		var field reflect.Value
+		for _, f := range fields {
+			if f.name == name {
+				field = v.Field(f.index)
+				break
+			}
+		}
+		if !field.IsValid() {
+			for _, f := range fields {
+				if strings.EqualFold(f.name, name) {
+					field = v.Field(f.index)
+					break
+				}
+			}
+		}
+		if err := d.decode(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在不知道目标类型时解码
+// 整数优先解码为 int64，map 的键都是字符串时解码为 map[string]interface{}
+func (d *mpDecoder) decodeInterface() (interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == mpNil:
+		return nil, nil
+	case c == mpTrue || c == mpFalse:
+		return c == mpTrue, nil
+	case mpIsInt(c):
+		i, u, signed, err := d.readInt(c)
+		if err != nil {
+			return nil, err
+		}
+		if signed {
+			return i, nil
+		}
+		if u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(u), nil
+	case c == mpFloat32:
+		n, err := d.readBE(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case c == mpFloat64:
+		n, err := d.readBE(8)
+		return math.Float64frombits(n), err
+	}
+	if n, ok, err := d.readBytesLen(c); ok {
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.readN(n)
+		if err != nil {
+			return nil, err
+		}
+		if c == mpBin8 || c == mpBin16 || c == mpBin32 {
+			return append([]byte(nil), b...), nil
+		}
+		return string(b), nil
+	}
+	if n, ok, err := d.readArrayLen(c); ok {
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = d.decodeInterface(); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	if n, ok, err := d.readMapLen(c); ok {
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeInterfaceMap(n)
+	}
+	return nil, fmt.Errorf("rpc codec: msgpack unsupported type 0x%02x", c)
+}
+
+func (d *mpDecoder) decodeInterfaceMap(n int) (interface{}, error) {
+	keys := make([]interface{}, n)
+	values := make([]interface{}, n)
+	allString := true
+	for i := 0; i < n; i++ {
+		var err error
+		if keys[i], err = d.decodeInterface(); err != nil {
+			return nil, err
+		}
+		if values[i], err = d.decodeInterface(); err != nil {
+			return nil, err
+		}
+		if _, ok := keys[i].(string); !ok {
+			allString = false
+		}
+	}
+	if allString {
+		m := make(map[string]interface{}, n)
+		for i := range keys {
+			m[keys[i].(string)] = values[i]
+		}
+		return m, nil
+	}
+	m := make(map[interface{}]interface{}, n)
+	for i := range keys {
+		if keys[i] != nil && !reflect.TypeOf(keys[i]).Comparable() {
+			return nil, fmt.Errorf("rpc codec: msgpack unhashable map key %T", keys[i])
+		}
+		m[keys[i]] = values[i]
+	}
+	return m, nil
+}
+
+// 跳过一个值，包括目标类型不认识的扩展类型
+func (d *mpDecoder) skip() error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	c, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == mpNil || c == mpTrue || c == mpFalse:
+		return nil
+	case mpIsInt(c):
+		_, _, _, err := d.readInt(c)
+		return err
+	case c == mpFloat32:
+		_, err := d.readN(4)
+		return err
+	case c == mpFloat64:
+		_, err := d.readN(8)
+		return err
+	}
+	if n, ok, err := d.readBytesLen(c); ok {
+		if err != nil {
+			return err
+		}
+		_, err = d.readN(n)
+		return err
+	}
+	if n, ok, err := d.readExtLen(c); ok {
+		if err != nil {
+			return err
+		}
+		// 扩展类型还有一个字节的类型标识
+		_, err = d.readN(n + 1)
+		return err
+	}
+	n, ok, err := d.readArrayLen(c)
+	if !ok {
+		if n, ok, err = d.readMapLen(c); ok {
+			n *= 2
+		}
+	}
+	if !ok {
+		return fmt.Errorf("rpc codec: msgpack unsupported type 0x%02x", c)
+	}
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := d.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
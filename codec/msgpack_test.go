@@ -0,0 +1,148 @@
+package codec
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type mpInner struct {
+	Name string `msgpack:"name"`
+	Tags []string
+}
+
+type mpOuter struct {
+	Int     int
+	Int8    int8
+	Uint64  uint64
+	Float   float64
+	Bool    bool
+	Bytes   []byte
+	Inner   mpInner
+	Ptr     *mpInner
+	Map     map[string]int
+	Slice   []int
+	Array   [2]uint16
+	Any     interface{}
+	Ignored string `msgpack:"-"`
+	Empty   string `msgpack:",omitempty"`
+	hidden  int
+}
+
+func TestMsgpack_RoundTrip(t *testing.T) {
+	in := mpOuter{
+		Int:    -70000,
+		Int8:   -5,
+		Uint64: math.MaxUint64,
+		Float:  3.5,
+		Bool:   true,
+		Bytes:  []byte{1, 2, 3},
+		Inner:  mpInner{Name: "inner", Tags: []string{"a", "b"}},
+		Ptr:    &mpInner{Name: "ptr"},
+		Map:    map[string]int{"one": 1, "two": 2},
+		Slice:  []int{1, -1, 300},
+		Array:  [2]uint16{7, 65535},
+		Any:    map[string]interface{}{"k": "v"},
+		hidden: 1,
+	}
+	var buf bytes.Buffer
+	if err := msgpackMarshal(&buf, &in); err != nil {
+		t.Fatal(err)
+	}
+	var out mpOuter
+	if err := msgpackUnmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	in.hidden = 0
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+}
+
+// 与 MessagePack 规范中的编码结果对比
+func TestMsgpack_Spec(t *testing.T) {
+	cases := []struct {
+		v    interface{}
+		want []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{1, []byte{0x01}},
+		{-1, []byte{0xff}},
+		{-33, []byte{0xd0, 0xdf}},
+		{256, []byte{0xcd, 0x01, 0x00}},
+		{"abc", []byte{0xa3, 'a', 'b', 'c'}},
+		{[]byte{0xff}, []byte{0xc4, 0x01, 0xff}},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{map[string]bool{"a": false}, []byte{0x81, 0xa1, 'a', 0xc2}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := msgpackMarshal(&buf, c.v); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), c.want) {
+			t.Fatalf("encode %v: expect % x, got % x", c.v, c.want, buf.Bytes())
+		}
+	}
+}
+
+func TestMsgpack_SkipUnknown(t *testing.T) {
+	// {"Name": "x", "Extra": [1, {"k": fixext1}], "Tags": ["t"]}
+	data := []byte{0x83,
+		0xa4, 'N', 'a', 'm', 'e', 0xa1, 'x',
+		0xa5, 'E', 'x', 't', 'r', 'a', 0x92, 0x01, 0x81, 0xa1, 'k', 0xd4, 0x01, 0x02,
+		0xa4, 'T', 'a', 'g', 's', 0x91, 0xa1, 't',
+	}
+	// 字段名 name 通过标签定义，这里的 Name 通过忽略大小写匹配
+	var out mpInner
+	if err := msgpackUnmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "x" || len(out.Tags) != 1 || out.Tags[0] != "t" {
+		t.Fatalf("unexpected result %+v", out)
+	}
+}
+
+// 对端发送的长度前缀和嵌套层数都不可信，应返回错误而不是耗尽内存或栈
+type mpByte byte
+
+func TestMsgpack_Malicious(t *testing.T) {
+	huge := []byte{0xdd, 0x7f, 0xff, 0xff, 0xff}
+	hugeMap := []byte{0xdf, 0x7f, 0xff, 0xff, 0xff}
+	targets := []func() interface{}{
+		func() interface{} { return new(interface{}) },
+		func() interface{} { return new([]int) },
+		func() interface{} { return new(map[string]string) },
+		func() interface{} { return new(mpInner) },
+	}
+	for _, data := range [][]byte{huge, hugeMap} {
+		for _, target := range targets {
+			v := target()
+			if err := msgpackUnmarshal(data, v); err == nil {
+				t.Fatalf("decode % x into %T: expect error", data, v)
+			}
+		}
+	}
+	// bin 解码到元素为自定义 byte 类型的数组
+	var named [4]mpByte
+	if err := msgpackUnmarshal([]byte{0xc4, 0x03, 0x01, 0x02, 0x03}, &named); err != nil || named != [4]mpByte{1, 2, 3} {
+		t.Fatalf("decode into %T: got %v, %v", named, named, err)
+	}
+	// 数组或 map 作为 interface{} 类型的 map 的键
+	for _, data := range [][]byte{{0x81, 0x91, 0x01, 0x01}, {0x81, 0x81, 0x01, 0x01, 0x01}} {
+		var m map[interface{}]int
+		if err := msgpackUnmarshal(data, &m); err == nil {
+			t.Fatalf("decode % x into %T: expect error", data, m)
+		}
+	}
+	deep := bytes.Repeat([]byte{0x91}, 1<<20)
+	for _, target := range targets {
+		v := target()
+		if err := msgpackUnmarshal(deep, v); err == nil {
+			t.Fatalf("decode deep array into %T: expect error", v)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package codec
+
+import (
+	"bytes"
+	"sync"
+)
+
+// 超过该容量的缓冲区不放回池中，避免偶尔出现的大帧长期占用内存
+const maxPooledBufferSize = 64 << 10
+
+// 读取帧时使用的缓冲区
+type frameBuffer struct {
+	b []byte
+}
+
+var frameBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &frameBuffer{b: make([]byte, 0, 512)}
+	},
+}
+
+// 获取一个长度为 n 的帧缓冲区
+func getFrameBuffer(n int) *frameBuffer {
+	fb := frameBufferPool.Get().(*frameBuffer)
+	if cap(fb.b) < n {
+		fb.b = make([]byte, n)
+	}
+	fb.b = fb.b[:n]
+	return fb
+}
+
+func putFrameBuffer(fb *frameBuffer) {
+	if cap(fb.b) > maxPooledBufferSize {
+		return
+	}
+	frameBufferPool.Put(fb)
+}
+
+// 编码时使用的缓冲区
+var encodeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getEncodeBuffer() *bytes.Buffer {
+	buf := encodeBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putEncodeBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	encodeBufferPool.Put(buf)
+}
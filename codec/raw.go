@@ -0,0 +1,35 @@
+package codec
+
+import "errors"
+
+// RawMessage 是已经编码好的 body，编码器会原样收发其中的字节而不做编解码
+// 可以作为参数或返回值的类型，用来实现不关心具体类型的代理、录制和网关
+// 只有每个 body 都自成一体的编码方式（如 JSON 和 MessagePack）支持 RawMessage
+type RawMessage []byte
+
+// gob 的 body 依赖于连接上之前发送过的类型信息，无法脱离连接单独转发
+var ErrRawMessageNotSupported = errors.New("rpc codec: RawMessage is not supported by this codec")
+
+// body 为 RawMessage 或 *RawMessage 时返回其中的字节
+func rawBytes(body interface{}) ([]byte, bool) {
+	switch b := body.(type) {
+	case RawMessage:
+		return b, true
+	case *RawMessage:
+		if b == nil {
+			return nil, true
+		}
+		return *b, true
+	}
+	return nil, false
+}
+
+// body 为 *RawMessage 时将 raw 复制到其中
+// 帧层的缓冲区会被复用，所以必须复制
+func setRaw(body interface{}, raw []byte) bool {
+	b, ok := body.(*RawMessage)
+	if ok {
+		*b = append((*b)[:0], raw...)
+	}
+	return ok
+}
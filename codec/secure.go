@@ -0,0 +1,175 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 握手时双方各自生成的随机数的长度
+const NonceSize = 16
+
+// 单条加密记录中明文的最大长度，更长的数据会被拆分为多条记录
+const maxRecordSize = 64 << 10
+
+var (
+	// 记录的序号与期望的不一致，说明记录被重放、丢弃或者乱序
+	ErrReplay = errors.New("rpc codec: replayed or reordered record")
+	// 记录无法通过 AES-GCM 的认证，说明密钥不一致或者数据被篡改
+	ErrTampered = errors.New("rpc codec: record authentication failed")
+)
+
+// SecureError 表示加密传输层发生的错误，可以通过 errors.Is 判断具体原因
+type SecureError struct {
+	// 出错的操作，如 "read"、"write"、"open"
+	Op  string
+	Err error
+}
+
+func (e *SecureError) Error() string {
+	return "rpc codec: secure " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *SecureError) Unwrap() error {
+	return e.Err
+}
+
+// 使用预共享密钥和双方的随机数，为两个方向分别派生一个 AES-256 的会话密钥
+func DeriveKeys(psk, clientNonce, serverNonce []byte) (clientKey, serverKey []byte) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, psk)
+		mac.Write([]byte(label))
+		mac.Write(clientNonce)
+		mac.Write(serverNonce)
+		return mac.Sum(nil)
+	}
+	return derive("minirpc client key"), derive("minirpc server key")
+}
+
+// 返回一个包装了 inner 的编码器构造函数
+// inner 产生的所有数据都会先经过 AES-GCM 加密再写入连接
+// sendKey 用于加密发送的数据，recvKey 用于解密接收的数据
+func Secure(inner NewCodecFunc, sendKey, recvKey []byte) (NewCodecFunc, error) {
+	seal, err := newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	open, err := newGCM(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return func(conn io.ReadWriteCloser, cfg *Config) Codec {
+		return inner(&secureConn{conn: conn, seal: seal, open: open}, cfg)
+	}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("rpc codec: invalid secure key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// 加密的连接，数据以记录为单位发送
+// 每条记录的格式为：4 字节的密文长度 + 8 字节的序号 + 密文
+// 序号同时作为 AES-GCM 的 nonce，每个方向从 0 开始递增，接收方只接受期望的序号
+type secureConn struct {
+	conn       io.ReadWriteCloser
+	seal, open cipher.AEAD
+	sendSeq    uint64
+	recvSeq    uint64
+	// 已解密但还没有被读取的明文
+	plain []byte
+	// 复用的收发缓冲区
+	rbuf, wbuf []byte
+}
+
+func (c *secureConn) nonce(seq uint64) []byte {
+	nonce := make([]byte, c.seal.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxRecordSize {
+			n = maxRecordSize
+		}
+		if err := c.writeRecord(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *secureConn) writeRecord(p []byte) error {
+	seq := c.sendSeq
+	c.sendSeq++
+	var head [12]byte
+	binary.BigEndian.PutUint64(head[4:], seq)
+	c.wbuf = append(c.wbuf[:0], head[:]...)
+	c.wbuf = c.seal.Seal(c.wbuf, c.nonce(seq), p, head[4:])
+	binary.BigEndian.PutUint32(c.wbuf, uint32(len(c.wbuf)-len(head)))
+	if _, err := c.conn.Write(c.wbuf); err != nil {
+		return &SecureError{Op: "write", Err: err}
+	}
+	return nil
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	for len(c.plain) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *secureConn) readRecord() error {
+	var head [12]byte
+	if _, err := io.ReadFull(c.conn, head[:]); err != nil {
+		// 在记录的边界上断开连接是正常的关闭
+		if err == io.EOF {
+			return err
+		}
+		return &SecureError{Op: "read", Err: err}
+	}
+	length := binary.BigEndian.Uint32(head[:4])
+	if length > maxRecordSize+uint32(c.open.Overhead()) {
+		return &SecureError{Op: "read", Err: fmt.Errorf("record of %d bytes is too large", length)}
+	}
+	seq := binary.BigEndian.Uint64(head[4:])
+	if seq != c.recvSeq {
+		return &SecureError{Op: "open", Err: fmt.Errorf("%w: expect %d, got %d", ErrReplay, c.recvSeq, seq)}
+	}
+	if cap(c.rbuf) < int(length) {
+		c.rbuf = make([]byte, length)
+	}
+	c.rbuf = c.rbuf[:length]
+	if _, err := io.ReadFull(c.conn, c.rbuf); err != nil {
+		return &SecureError{Op: "read", Err: err}
+	}
+	plain, err := c.open.Open(c.rbuf[:0], c.nonce(seq), c.rbuf, head[4:])
+	if err != nil {
+		return &SecureError{Op: "open", Err: ErrTampered}
+	}
+	c.recvSeq++
+	c.plain = plain
+	return nil
+}
+
+func (c *secureConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,72 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newSecureCodec(t *testing.T, conn *loopConn, sendKey, recvKey []byte) Codec {
+	f, err := Secure(NewGobCodec, sendKey, recvKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f(conn, nil)
+}
+
+func TestSecure(t *testing.T) {
+	psk := []byte("minirpc pre-shared key")
+	clientKey, serverKey := DeriveKeys(psk, bytes.Repeat([]byte{1}, NonceSize), bytes.Repeat([]byte{2}, NonceSize))
+	write := func(conn *loopConn) {
+		cc := newSecureCodec(t, conn, clientKey, serverKey)
+		if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &benchArgs{1, 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		conn := new(loopConn)
+		write(conn)
+		if bytes.Contains(conn.Bytes(), []byte("Foo.Sum")) {
+			t.Fatal("plain text leaked")
+		}
+		cc := newSecureCodec(t, conn, serverKey, clientKey)
+		var h Header
+		var args benchArgs
+		if err := cc.ReadHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.ReadBody(&args); err != nil {
+			t.Fatal(err)
+		}
+		if h.ServiceMethod != "Foo.Sum" || args.B != 2 {
+			t.Fatalf("unexpected message %+v %+v", h, args)
+		}
+	})
+	t.Run("tampered", func(t *testing.T) {
+		conn := new(loopConn)
+		write(conn)
+		conn.Bytes()[20] ^= 0xff
+		var h Header
+		err := newSecureCodec(t, conn, serverKey, clientKey).ReadHeader(&h)
+		var secureErr *SecureError
+		if !errors.As(err, &secureErr) || !errors.Is(err, ErrTampered) {
+			t.Fatalf("expect ErrTampered, got %v", err)
+		}
+	})
+	t.Run("replay", func(t *testing.T) {
+		conn := new(loopConn)
+		write(conn)
+		// 将第一条记录重复发送一次
+		record := append([]byte(nil), conn.Bytes()...)
+		conn.Write(record)
+		cc := newSecureCodec(t, conn, serverKey, clientKey)
+		var h Header
+		var args benchArgs
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(&args)
+		if err := cc.ReadHeader(&h); !errors.Is(err, ErrReplay) {
+			t.Fatalf("expect ErrReplay, got %v", err)
+		}
+	})
+}
@@ -8,16 +8,24 @@ import (
 const debugText = `<html>
 	<body>
 	<title>MiniRPC Services</title>
-	{{range .}}
+	{{with .Pool}}{{if .Workers}}
+	<hr>
+	Worker pool: {{.Workers}} workers, {{.Queued}}/{{.QueueSize}} queued, {{.Rejected}} rejected
+	{{end}}{{end}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Panics</th><th align=center>Timeout</th><th align=center>Max Concurrency</th><th align=center>Idempotent</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
+			<td align=left font=fixed>{{$name}}({{if $mtype.ContextAware}}context.Context, {{end}}{{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=center>{{$mtype.NumPanics}}</td>
+			<td align=center>{{if $mtype.Timeout}}{{$mtype.Timeout}}{{else}}-{{end}}</td>
+			<td align=center>{{if $mtype.MaxConcurrency}}{{$mtype.MaxConcurrency}}{{else}}-{{end}}</td>
+			<td align=center>{{if $mtype.Idempotent}}yes{{else}}-{{end}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -47,7 +55,10 @@ func (server DebugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		})
 		return true
 	})
-	err := debug.Execute(w, services)
+	err := debug.Execute(w, struct {
+		Pool     PoolStats
+		Services []*DebugService
+	}{server.server.PoolStats(), services})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
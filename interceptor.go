@@ -0,0 +1,69 @@
+package minirpc
+
+import "context"
+
+// 调用链中的下一环，链的末端是真正被调用的方法
+type Invoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// 拦截器包裹每一次方法调用，可以在调用 next 的前后做鉴权、日志、统计等工作
+// 不调用 next 而直接返回错误即可拦截这次调用
+// 同一个拦截器既可以用于服务端（Server.Use），也可以用于客户端（Client.Use）
+// 服务端：请求携带的 metadata 可以通过 MetadataFromContext(ctx) 获取
+// args 和 reply 与传给方法的参数相同，args 是值还是指针取决于方法的声明，reply 总是指针
+// 客户端：可以通过 WithMetadata 向 ctx 中添加随请求发送的 metadata，再传给 next
+// 不调用 next 而直接填充 reply 即可在测试中模拟某个方法
+type Interceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error
+
+// 将拦截器串联起来，第一个拦截器在最外层，final 是链的末端
+// 可以用来在 Client 和 Server 之外的地方复用同样的拦截器，如 XClient
+func ChainInterceptors(interceptors []Interceptor, final Invoker) Invoker {
+	invoker := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
+
+// 添加服务器级别的拦截器，作用于所有服务，应在开始处理连接之前调用
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.interceptors = append(server.interceptors[:len(server.interceptors):len(server.interceptors)], interceptors...)
+}
+
+// 调用请求对应的方法，依次经过服务器级别和服务级别的拦截器
+// 拦截器和方法中的 panic 都在这里恢复并以 *panicError 返回，拦截器自己也可以先恢复方法中的 panic
+func (server *Server) invoke(ctx context.Context, req *request) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(req.header.ServiceMethod, req.mtype, r)
+		}
+	}()
+	server.mu.RLock()
+	interceptors := server.interceptors
+	server.mu.RUnlock()
+	if len(interceptors) == 0 && len(req.svc.interceptors) == 0 {
+		return req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+	}
+	final := func(ctx context.Context, _ string, _, _ interface{}) error {
+		return req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+	}
+	invoker := ChainInterceptors(append(interceptors[:len(interceptors):len(interceptors)], req.svc.interceptors...), final)
+	return invoker(ctx, req.header.ServiceMethod, req.argv.Interface(), req.replyv.Interface())
+}
+
+// 添加客户端的拦截器，作用于之后通过 Call 和 Go 发起的所有调用
+func (client *Client) Use(interceptors ...Interceptor) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.interceptors = append(client.interceptors[:len(client.interceptors):len(client.interceptors)], interceptors...)
+}
+
+func (client *Client) getInterceptors() []Interceptor {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.interceptors
+}
@@ -0,0 +1,107 @@
+package minirpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Metadata 是随请求和响应一起传输的键值对，如认证信息、链路追踪 ID、租户 ID 等
+type Metadata map[string]string
+
+// 返回 md 的副本
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	out := make(Metadata, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+// 合并多个 Metadata，相同的键以后面的为准
+func joinMetadata(mds ...Metadata) Metadata {
+	var out Metadata
+	for _, md := range mds {
+		for k, v := range md {
+			if out == nil {
+				out = make(Metadata, len(md))
+			}
+			out[k] = v
+		}
+	}
+	return out
+}
+
+type (
+	// 客户端要发送的 metadata
+	outgoingMetadataKey struct{}
+	// 服务端收到的 metadata
+	incomingMetadataKey struct{}
+	// 服务端要在回复中附带的 metadata
+	replyMetadataKey struct{}
+	// 客户端接收回复中 metadata 的位置
+	replyReceiverKey struct{}
+)
+
+// 返回附带了 md 的 context，Client.Call 会将其随请求发送给服务端
+// 多次调用时会与 ctx 中已有的 metadata 合并
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	old, _ := ctx.Value(outgoingMetadataKey{}).(Metadata)
+	return context.WithValue(ctx, outgoingMetadataKey{}, joinMetadata(old, md))
+}
+
+// 获取 ctx 中将要随请求发送的 metadata
+func OutgoingMetadata(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(outgoingMetadataKey{}).(Metadata)
+	return md, ok
+}
+
+// 返回的 context 用于 Client.Call 时，服务端回复中附带的 metadata 会被写入 *md
+// 调用返回错误时，服务端在出错前设置的 metadata 同样会被写入
+func WithReplyMetadata(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, replyReceiverKey{}, md)
+}
+
+// 在服务端获取请求中附带的 metadata，返回的 Metadata 不应被修改
+func MetadataFromContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(incomingMetadataKey{}).(Metadata)
+	return md, ok
+}
+
+// 服务端收集回复中要附带的 metadata，处理请求的过程中可能被并发修改
+type replyMetadata struct {
+	mu sync.Mutex
+	md Metadata
+}
+
+func (r *replyMetadata) get() Metadata {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.md
+}
+
+var errNoReplyMetadata = errors.New("rpc server: context is not a server request context")
+
+// 在服务端设置回复中附带的 metadata，多次调用时结果会被合并
+// 只能在处理请求的过程中使用服务端传入的 ctx 调用
+func SetReplyMetadata(ctx context.Context, md Metadata) error {
+	r, ok := ctx.Value(replyMetadataKey{}).(*replyMetadata)
+	if !ok {
+		return errNoReplyMetadata
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.md = joinMetadata(r.md, md)
+	return nil
+}
+
+// 为服务端收到的请求创建 context，携带请求的 metadata 和收集回复 metadata 的容器
+func newRequestContext(parent context.Context, md Metadata) (context.Context, *replyMetadata) {
+	reply := new(replyMetadata)
+	ctx := context.WithValue(parent, incomingMetadataKey{}, md)
+	ctx = context.WithValue(ctx, replyMetadataKey{}, reply)
+	return ctx, reply
+}
@@ -0,0 +1,241 @@
+package minirpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 连接断开期间发起的调用在快速失败模式下返回的错误
+var ErrNotConnected = errors.New("rpc client: not connected")
+
+// ReconnectingClient 的连接状态
+type ConnState int
+
+const (
+	// 正在建立连接并握手
+	StateConnecting ConnState = iota
+	// 连接可用
+	StateReady
+	// 连接断开或者建立失败，等待退避时间后重试
+	StateDisconnected
+	// 客户端已经关闭，不会再重连
+	StateClosed
+)
+
+var connStateNames = [...]string{
+	StateConnecting:   "Connecting",
+	StateReady:        "Ready",
+	StateDisconnected: "Disconnected",
+	StateClosed:       "Closed",
+}
+
+func (s ConnState) String() string {
+	if s >= 0 && int(s) < len(connStateNames) {
+		return connStateNames[s]
+	}
+	return "ConnState(" + strconv.Itoa(int(s)) + ")"
+}
+
+// ReconnectingClient 的配置项
+type ReconnectOption func(*ReconnectingClient)
+
+// 设置重连的退避时间，每次失败后翻倍，直到 max，实际等待的时间带有随机的抖动
+// 默认为 100ms 到 10s
+func WithBackoff(min, max time.Duration) ReconnectOption {
+	return func(rc *ReconnectingClient) {
+		rc.minBackoff, rc.maxBackoff = min, max
+	}
+}
+
+// 连接断开期间发起的调用会等待重连成功，直到 ctx 结束
+// 默认立即返回 ErrNotConnected
+func WithWaitForReady() ReconnectOption {
+	return func(rc *ReconnectingClient) {
+		rc.waitForReady = true
+	}
+}
+
+// 连接状态变化时调用 f，f 不应阻塞
+func WithStateChange(f func(ConnState)) ReconnectOption {
+	return func(rc *ReconnectingClient) {
+		rc.onStateChange = f
+	}
+}
+
+// ReconnectingClient 在连接断开、或者服务端通知关闭之后，自动重新连接到同一个地址
+// 每次重连都会重新进行 Option 的握手
+type ReconnectingClient struct {
+	rpcAddress string
+	opt        *Option
+
+	minBackoff, maxBackoff time.Duration
+	waitForReady           bool
+	onStateChange          func(ConnState)
+
+	mu     sync.Mutex
+	client *Client
+	state  ConnState
+	// 状态变化时关闭并换成新的 channel，用于等待重连
+	changed chan struct{}
+	closed  chan struct{}
+}
+
+// 创建一个自动重连的客户端，rpcAddress 的格式与 XDial 相同
+// 连接在后台建立，创建时连接失败也不会返回错误
+func NewReconnectingClient(rpcAddress string, opt *Option, opts ...ReconnectOption) (*ReconnectingClient, error) {
+	if _, _, err := splitRPCAddress(rpcAddress); err != nil {
+		return nil, err
+	}
+	if _, err := parseOption(opt); err != nil {
+		return nil, err
+	}
+	rc := &ReconnectingClient{
+		rpcAddress: rpcAddress,
+		opt:        opt,
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 10 * time.Second,
+		changed:    make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(rc)
+	}
+	go rc.run()
+	return rc, nil
+}
+
+// 返回当前的连接状态
+func (rc *ReconnectingClient) State() ConnState {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.state
+}
+
+// 修改连接状态，连接可用时 client 不为 nil
+// 客户端已经关闭时返回 false
+func (rc *ReconnectingClient) setState(state ConnState, client *Client) bool {
+	rc.mu.Lock()
+	if rc.state == StateClosed {
+		rc.mu.Unlock()
+		return false
+	}
+	changed := rc.state != state
+	rc.state = state
+	rc.client = client
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+	rc.mu.Unlock()
+	if changed && rc.onStateChange != nil {
+		rc.onStateChange(state)
+	}
+	return true
+}
+
+// 维持连接，直到客户端被关闭
+func (rc *ReconnectingClient) run() {
+	for attempt := 0; ; {
+		if !rc.setState(StateConnecting, nil) {
+			return
+		}
+		client, err := XDial(rc.rpcAddress, rc.opt)
+		if err != nil {
+			logrus.Warnf("minirpc.ReconnectingClient: dial %s: %v", rc.rpcAddress, err)
+			if !rc.setState(StateDisconnected, nil) {
+				return
+			}
+			timer := time.NewTimer(backoff(rc.minBackoff, rc.maxBackoff, attempt))
+			attempt++
+			select {
+			case <-timer.C:
+				continue
+			case <-rc.closed:
+				timer.Stop()
+				return
+			}
+		}
+		attempt = 0
+		if !rc.setState(StateReady, client) {
+			_ = client.Close()
+			return
+		}
+		select {
+		case <-client.stopped:
+			// 服务端通知关闭时，原来的连接在已发送的请求返回后自行断开
+			logrus.Warnf("minirpc.ReconnectingClient: connection to %s lost, reconnecting", rc.rpcAddress)
+			if !rc.setState(StateDisconnected, nil) {
+				return
+			}
+		case <-rc.closed:
+			_ = client.Close()
+			return
+		}
+	}
+}
+
+// 获取可用的连接，连接断开时按配置等待或者立即返回错误
+func (rc *ReconnectingClient) getClient(ctx context.Context) (*Client, error) {
+	for {
+		rc.mu.Lock()
+		client, state, changed := rc.client, rc.state, rc.changed
+		rc.mu.Unlock()
+		if state == StateClosed {
+			return nil, ErrClientShutdown
+		}
+		if client != nil && client.Avaliable() {
+			return client, nil
+		}
+		if !rc.waitForReady {
+			return nil, ErrNotConnected
+		}
+		// 连接刚刚断开时状态可能还是 StateReady，同样等待状态的变化
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-rc.closed:
+			return nil, ErrClientShutdown
+		}
+	}
+}
+
+// 对服务器发起调用，并等待返回
+func (rc *ReconnectingClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	client, err := rc.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Call(ctx, serviceMethod, args, reply)
+}
+
+// 带有超时功能的调用
+func (rc *ReconnectingClient) CallTimeout(serviceMethod string, args, reply interface{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return rc.Call(ctx, serviceMethod, args, reply)
+}
+
+// 关闭客户端，不再重连
+func (rc *ReconnectingClient) Close() error {
+	rc.mu.Lock()
+	if rc.state == StateClosed {
+		rc.mu.Unlock()
+		return ErrClientShutdown
+	}
+	rc.state = StateClosed
+	client := rc.client
+	rc.client = nil
+	close(rc.closed)
+	rc.mu.Unlock()
+	if rc.onStateChange != nil {
+		rc.onStateChange(StateClosed)
+	}
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
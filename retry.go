@@ -0,0 +1,145 @@
+package minirpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetryPolicy 描述客户端自动重试失败调用的策略
+// 只有错误码在 RetryableCodes 中，并且方法是幂等的调用才会被重试
+// 服务端通过 MethodIdempotent 标记的方法在握手时告知客户端，客户端也可以通过 IdempotentMethods 自行声明
+// 请求没有被服务端处理的错误（如 CodeOverloaded、连接不可用）不要求方法幂等
+type RetryPolicy struct {
+	// 包括第一次在内最多调用的次数，小于等于 1 时不重试
+	MaxAttempts int
+	// 重试前等待的时间，每次翻倍，直到 MaxBackoff，实际等待的时间带有随机的抖动
+	// MaxBackoff 为 0 时不限制等待的时间
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// 可以重试的错误码，为空时使用 CodeUnavailable 和 CodeOverloaded
+	// 连接断开等没有错误码的错误被视为 CodeUnavailable
+	RetryableCodes []Code
+	// 客户端声明为幂等的方法，格式为 "Service.Method"
+	IdempotentMethods []string
+}
+
+var defaultRetryableCodes = []Code{CodeUnavailable, CodeOverloaded}
+
+// 判断调用返回的 err 是否可以重试，idempotent 表示方法是否幂等
+// ctx 结束导致的错误不会被重试
+func (p *RetryPolicy) Retryable(err error, idempotent bool) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	code, sent := CodeUnavailable, true
+	var st *Status
+	if errors.As(err, &st) {
+		code = st.Code
+	} else if errors.Is(err, ErrClientShutdown) || errors.Is(err, ErrNotConnected) {
+		// 连接不可用，请求没有发送出去
+		sent = false
+	}
+	codes := p.RetryableCodes
+	if len(codes) == 0 {
+		codes = defaultRetryableCodes
+	}
+	for _, c := range codes {
+		if c == code {
+			// 服务器过载时请求没有被处理
+			return idempotent || !sent || code == CodeOverloaded
+		}
+	}
+	return false
+}
+
+// 第 attempt 次重试前等待的时间
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	return backoff(p.InitialBackoff, p.MaxBackoff, attempt-1)
+}
+
+// 方法是否被客户端声明为幂等
+func (p *RetryPolicy) Idempotent(serviceMethod string) bool {
+	for _, m := range p.IdempotentMethods {
+		if m == serviceMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// 第 attempt 次失败后等待的时间，从 min 开始每次翻倍，直到 max，max 为 0 时不设上限
+// 带有 [d/2, d] 范围内的随机抖动
+func backoff(min, max time.Duration, attempt int) time.Duration {
+	d := min
+	for i := 0; i < attempt && d > 0 && d <= math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// 在第 attempt 次重试前等待 Backoff(attempt)，ctx 结束时提前返回 false
+func (p *RetryPolicy) Wait(ctx context.Context, attempt int) bool {
+	d := p.Backoff(attempt)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// 方法是否幂等，包括服务端在握手时告知的和 RetryPolicy 中声明的
+func (client *Client) Idempotent(serviceMethod string) bool {
+	if _, ok := client.idempotent[serviceMethod]; ok {
+		return true
+	}
+	return client.option.RetryPolicy != nil && client.option.RetryPolicy.Idempotent(serviceMethod)
+}
+
+// 按 RetryPolicy 调用，连接已经不可用时不再重试
+func (client *Client) callWithRetry(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	policy := client.option.RetryPolicy
+	for attempt := 1; ; attempt++ {
+		err := client.call(ctx, serviceMethod, args, reply)
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !client.Avaliable() ||
+			!policy.Retryable(err, client.Idempotent(serviceMethod)) {
+			return err
+		}
+		logrus.Warnf("rpc client: call %s failed: %v, retrying", serviceMethod, err)
+		if !policy.Wait(ctx, attempt) {
+			return err
+		}
+	}
+}
+
+// 返回服务端所有被标记为幂等的方法
+func (server *Server) idempotentMethods() []string {
+	var methods []string
+	server.serviceMap.Range(func(namei, svci interface{}) bool {
+		for name, m := range svci.(*service).method {
+			if m.idempotent {
+				methods = append(methods, namei.(string)+"."+name)
+			}
+		}
+		return true
+	})
+	sort.Strings(methods)
+	return methods
+}
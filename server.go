@@ -1,6 +1,8 @@
 package minirpc
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,8 +28,40 @@ type Option struct {
 	// 连接超时时间，0 表示无限制
 	ConnectTimeout time.Duration
 	HandleTimeout  time.Duration
+	// 客户端读取响应时单帧的最大长度，0 表示使用 codec.DefaultMaxFrameSize
+	// 服务端不信任客户端发来的值，使用自己的 WithMaxFrameSize 配置
+	MaxFrameSize uint32
+	// 是否为每一帧附加 CRC32 校验和，服务端会采用客户端的设置
+	Checksum bool
+	// body 使用的压缩算法，服务端在握手的回复中确认实际使用的算法
+	Compression codec.Compression
+	// 超过该长度的 body 才会被压缩，0 表示使用 codec.DefaultCompressThreshold
+	CompressThreshold int
+	// 请求中表示 CodecType 不可用时客户端可以接受的备选编码，按优先级排列
+	// 回复中表示服务端支持的所有编码
+	Codecs []codec.Type
+	// 预共享密钥，设置后使用 AES-GCM 加密传输，只在本地使用，不会在握手中发送
+	PreSharedKey []byte `json:"-"`
+	// 握手时双方交换的随机数，与预共享密钥一起派生本次连接的会话密钥
+	ClientNonce []byte `json:",omitempty"`
+	ServerNonce []byte `json:",omitempty"`
+	// 回复中表示服务端标记为幂等的方法，格式为 "Service.Method"，请求中的值会被忽略
+	IdempotentMethods []string `json:",omitempty"`
+	// 客户端自动重试失败调用的策略，为 nil 时不重试，只在本地使用，不会在握手中发送
+	RetryPolicy *RetryPolicy `json:"-"`
 }
 
+// 服务端不支持客户端提出的任何一种编码方式
+var ErrCodecNotSupported = errors.New("rpc: codec not supported")
+
+// 服务端处理请求时，被调用的方法发生了 panic，Details 中的 "panic" 为 panic 的值
+// 使用专门的错误码 CodePanic，方法自己返回的错误不会被 errors.Is 判断为 ErrPanic
+var ErrPanic = &Status{Code: CodePanic, Message: "rpc: service method panicked"}
+
+// 服务端处理请求的时间超过了 Option.HandleTimeout 或者方法的超时设置，Details 中的 "timeout" 为超时时间
+// 其他 CodeDeadlineExceeded 的错误，如请求到达时已经过了截止时间，不会被 errors.Is 判断为 ErrHandleTimeout
+var ErrHandleTimeout = &Status{Code: CodeDeadlineExceeded, Message: "rpc: request handle timeout"}
+
 var DefaultCodecType = codec.GobType
 
 var DefaultOption = &Option{
@@ -38,17 +72,192 @@ var DefaultOption = &Option{
 
 type Server struct {
 	serviceMap sync.Map
+	// 读取请求时单帧的最大长度
+	maxFrameSize uint32
+	// 服务器支持的编码方式，为空时支持所有已注册的编码
+	codecs []codec.Type
+	// 预共享密钥，设置后只接受加密的连接
+	psk []byte
+	// 记录方法中的 panic 后是否重新抛出
+	rePanic bool
+	// 工作池，jobs 为 nil 时每个请求使用一个新的协程
+	workers  int
+	jobs     chan func()
+	rejected uint64
+	// 保护 jobs 的关闭，工作池停止后 jobs 被关闭
+	poolMu      sync.RWMutex
+	poolStopped bool
+
+	mu sync.RWMutex
+	// 作用于所有服务的拦截器
+	interceptors []Interceptor
+	// 正在使用的监听器和连接，关闭服务器时使用
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	connWG     sync.WaitGroup
+	inShutdown bool
+}
+
+// 服务器的配置项
+type ServerOption func(*Server)
+
+// 设置读取请求时单帧的最大长度，超过的请求会被拒绝
+func WithMaxFrameSize(size uint32) ServerOption {
+	return func(server *Server) {
+		server.maxFrameSize = size
+	}
 }
 
-func NewServer() *Server {
-	return &Server{}
+// 限制服务器支持的编码方式，握手时按客户端给出的优先级在其中选择
+func WithCodecs(types ...codec.Type) ServerOption {
+	return func(server *Server) {
+		server.codecs = types
+	}
+}
+
+// 设置预共享密钥，服务器将只接受使用相同密钥加密的连接
+func WithPreSharedKey(key []byte) ServerOption {
+	return func(server *Server) {
+		server.psk = key
+	}
+}
+
+// 方法发生 panic 时，在记录日志和统计之后重新抛出，通常在测试中使用以便尽早发现问题
+// 默认情况下 panic 会被恢复，并向客户端返回 ErrPanic
+func WithRePanic() ServerOption {
+	return func(server *Server) {
+		server.rePanic = true
+	}
+}
+
+func NewServer(opts ...ServerOption) *Server {
+	server := &Server{
+		maxFrameSize: codec.DefaultMaxFrameSize,
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	server.startWorkers()
+	return server
 }
 
 var DefaultServer = NewServer()
 
 // 注册一个结构体的所有方法
 func (server *Server) Register(rcvr interface{}) error {
-	svc := newService(rcvr)
+	return server.RegisterName("", rcvr)
+}
+
+// 注册一个结构体的所有方法，并为它设置只作用于该服务的拦截器
+// 与 RegisterWithOptions(rcvr, WithServiceInterceptors(interceptors...)) 相同
+func (server *Server) RegisterWithInterceptors(rcvr interface{}, interceptors ...Interceptor) error {
+	return server.RegisterWithOptions(rcvr, WithServiceInterceptors(interceptors...))
+}
+
+// 注册一个结构体的所有方法，并通过 MethodOption 单独配置其中的方法或者设置服务的拦截器
+func (server *Server) RegisterWithOptions(rcvr interface{}, opts ...MethodOption) error {
+	return server.RegisterName("", rcvr, opts...)
+}
+
+// 以指定的服务名注册一个结构体的所有方法，同一类型的多个实例可以使用不同的名字注册
+// name 为空时使用结构体的名字
+func (server *Server) RegisterName(name string, rcvr interface{}, opts ...MethodOption) error {
+	svc, err := server.buildService(name, rcvr, opts)
+	if err != nil {
+		return err
+	}
+	return server.addService(svc)
+}
+
+// 将一个函数注册为方法，serviceMethod 的格式为 "Service.Method"
+// 函数的签名与结构体的方法相同，只是没有接收者，如 func(args Args, reply *int) error
+// 同一服务名下可以注册多个函数，但不能与通过结构体注册的服务同名
+func (server *Server) RegisterFunc(serviceMethod string, fn interface{}, opts ...MethodOption) error {
+	dot := strings.IndexByte(serviceMethod, '.')
+	if dot <= 0 || dot == len(serviceMethod)-1 || strings.LastIndexByte(serviceMethod, '.') != dot {
+		return errors.New("rpc: service/method ill-formed: " + serviceMethod)
+	}
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func || f.IsNil() {
+		return fmt.Errorf("rpc: %s is not a function", serviceMethod)
+	}
+	mtype, err := newMethodType(reflect.Method{Name: methodName, Type: f.Type(), Func: f}, 0)
+	if err != nil {
+		return err
+	}
+
+	// 除 WithServiceInterceptors 作用于整个服务外，opts 只作用于这个函数
+	svc := &service{name: serviceName, method: map[string]*methodType{methodName: mtype}}
+	for _, opt := range opts {
+		if err := opt(svc); err != nil {
+			return err
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	// 正在处理的请求可能在读取原来的服务，因此复制一份再替换
+	if svci, ok := server.serviceMap.Load(serviceName); ok {
+		old := svci.(*service)
+		if old.rcvr.IsValid() {
+			return errors.New("rpc: service already defined: " + serviceName)
+		}
+		for name, m := range old.method {
+			if _, dup := svc.method[name]; dup {
+				return errors.New("rpc: method already defined: " + serviceName + "." + name)
+			}
+			svc.method[name] = m
+		}
+		svc.interceptors = append(old.interceptors[:len(old.interceptors):len(old.interceptors)], svc.interceptors...)
+	}
+	server.serviceMap.Store(serviceName, svc)
+	logrus.Infof("minirpc server: register func %s", serviceMethod)
+	return nil
+}
+
+// 注销一个服务，之后对它的调用会返回找不到服务的错误，正在处理的请求不受影响
+func (server *Server) Unregister(name string) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, ok := server.serviceMap.LoadAndDelete(name); !ok {
+		return errors.New("rpc: can't find service " + name)
+	}
+	return nil
+}
+
+// 使用新的实现原子地替换已注册的服务，正在处理的请求仍使用原来的实现
+// 新的实现不会继承原服务的拦截器和方法配置，需要的话通过 opts 重新指定，拦截器使用 WithServiceInterceptors
+func (server *Server) Replace(name string, rcvr interface{}, opts ...MethodOption) error {
+	svc, err := server.buildService(name, rcvr, opts)
+	if err != nil {
+		return err
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, ok := server.serviceMap.Load(svc.name); !ok {
+		return errors.New("rpc: can't find service " + svc.name)
+	}
+	server.serviceMap.Store(svc.name, svc)
+	return nil
+}
+
+func (server *Server) buildService(name string, rcvr interface{}, opts []MethodOption) (*service, error) {
+	svc, err := newService(name, rcvr)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		if err := opt(svc); err != nil {
+			return nil, err
+		}
+	}
+	return svc, nil
+}
+
+func (server *Server) addService(svc *service) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
 	if _, dup := server.serviceMap.LoadOrStore(svc.name, svc); dup {
 		return errors.New("rpc: service already defined: " + svc.name)
 	}
@@ -59,29 +268,38 @@ func (server *Server) Register(rcvr interface{}) error {
 // service 表示一个被注册的类型和他的方法
 // mtype 表示要被调用的方法
 func (server *Server) findService(serviceMethod string) (*service, *methodType, error) {
-	strs := strings.Split(serviceMethod, ".")
-	if len(strs) != 2 {
-		return nil, nil, errors.New("rpc: service/method request ill-formed: " + serviceMethod)
+	// 只能有一个 "."，不使用 strings.Split 以免每次请求都分配内存
+	dot := strings.IndexByte(serviceMethod, '.')
+	if dot < 0 || strings.LastIndexByte(serviceMethod, '.') != dot {
+		return nil, nil, Errorf(CodeInvalidArgument, "rpc: service/method request ill-formed: %s", serviceMethod)
 	}
-	serviceName, methodName := strs[0], strs[1]
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
 	svci, ok := server.serviceMap.Load(serviceName)
 	if !ok {
-		return nil, nil, errors.New("rpc: can't find service " + serviceName)
+		return nil, nil, Errorf(CodeNotFound, "rpc: can't find service %s", serviceName)
 	}
 	svc := svci.(*service)
 	mtype, ok := svc.method[methodName]
 	if !ok {
-		return nil, nil, errors.New("rpc: can't find method " + methodName)
+		return nil, nil, Errorf(CodeNotFound, "rpc: can't find method %s", methodName)
 	}
 	return svc, mtype, nil
 }
 
 // 接收一个连接并处理请求
+// 服务器关闭后返回
 func (server *Server) Accept(linstener net.Listener) {
+	if !server.trackListener(linstener, true) {
+		_ = linstener.Close()
+		return
+	}
+	defer server.trackListener(linstener, false)
 	for {
 		conn, err := linstener.Accept()
 		if err != nil {
-			logrus.Errorf("minirpc.Server.Accept: %v", err)
+			if !server.shuttingDown() {
+				logrus.Errorf("minirpc.Server.Accept: %v", err)
+			}
 			return
 		}
 		// logrus.Info("connection from: ", conn.RemoteAddr())
@@ -92,6 +310,11 @@ func (server *Server) Accept(linstener net.Listener) {
 // HandleConn 处理单个连接，并阻塞程序运行直到连接关闭
 func (server *Server) HandleConn(conn io.ReadWriteCloser) {
 	defer conn.Close()
+	sc := &serverConn{rwc: conn}
+	if !server.trackConn(sc, true) {
+		return
+	}
+	defer server.trackConn(sc, false)
 	// 读取报文的头部
 	option, err := server.readOption(conn)
 	if err != nil {
@@ -99,19 +322,95 @@ func (server *Server) HandleConn(conn io.ReadWriteCloser) {
 		return
 	}
 
-	// 获取对应的编码器
-	codecFunc, ok := codec.NewCodecFuncMap[option.CodecType]
-	if !ok {
+	// 获取对应的编码器，回复中的 CodecType 为空表示没有可用的编码
+	supported := server.supportedCodecs()
+	codecFunc := server.selectCodec(option, supported)
+	option.Codecs = supported
+	// 不认识的压缩算法不会导致握手失败，而是在回复中告知客户端不压缩
+	if !option.Compression.Valid() {
+		option.Compression = codec.CompressionNone
+	}
+	if codecFunc == nil {
 		logrus.Errorf("minirpc.Server.HandleConn: codec type error")
+		_ = json.NewEncoder(conn).Encode(option)
 		return
 	}
-	codec := codecFunc(conn)
+	// 服务端没有配置密钥时，回复中不会有服务端的随机数，客户端据此得知服务端不支持加密
+	if server.psk != nil {
+		codecFunc, err = server.secureCodec(codecFunc, option)
+		if err != nil {
+			logrus.Error("minirpc.Server.HandleConn: ", err)
+			_ = json.NewEncoder(conn).Encode(option)
+			return
+		}
+	} else {
+		option.ClientNonce = nil
+	}
+	option.IdempotentMethods = server.idempotentMethods()
+	cc := codecFunc(conn, &codec.Config{
+		MaxFrameSize:      server.maxFrameSize,
+		Checksum:          option.Checksum,
+		Compression:       option.Compression,
+		CompressThreshold: option.CompressThreshold,
+	})
 	// 两次握手，解决 TCP 粘包问题
 	if err := json.NewEncoder(conn).Encode(option); err != nil {
 		logrus.Error("minirpc.Server.HandleConn: option error: ", err)
 		return
 	}
-	server.handleCodec(codec, option)
+	sending := new(sync.Mutex)
+	// 握手期间服务器开始关闭时，Shutdown 无法通知这个连接，由这里补发
+	if server.activateConn(sc, cc, sending) {
+		server.drainConn(sc)
+	}
+	server.handleCodec(sc, cc, sending, option)
+}
+
+// 生成服务端的随机数并派生会话密钥，返回加密的编码器构造函数
+// 回复中带有服务端的随机数即表示服务端要求加密，未加密的客户端据此断开连接
+func (server *Server) secureCodec(codecFunc codec.NewCodecFunc, option *Option) (codec.NewCodecFunc, error) {
+	option.ServerNonce = make([]byte, codec.NonceSize)
+	if _, err := rand.Read(option.ServerNonce); err != nil {
+		return nil, err
+	}
+	if len(option.ClientNonce) != codec.NonceSize {
+		return nil, errors.New("minirpc: encryption required but client nonce is missing")
+	}
+	clientKey, serverKey := codec.DeriveKeys(server.psk, option.ClientNonce, option.ServerNonce)
+	return codec.Secure(codecFunc, serverKey, clientKey)
+}
+
+// 返回服务器支持的编码方式
+func (server *Server) supportedCodecs() []codec.Type {
+	if len(server.codecs) == 0 {
+		return codec.Types()
+	}
+	var types []codec.Type
+	for _, typ := range server.codecs {
+		if _, ok := codec.Lookup(typ); ok {
+			types = append(types, typ)
+		}
+	}
+	return types
+}
+
+// 按客户端给出的优先级选择编码方式，并将选择的结果写回 option.CodecType
+// 没有可用的编码时返回 nil
+func (server *Server) selectCodec(option *Option, supported []codec.Type) codec.NewCodecFunc {
+	candidates := append([]codec.Type{option.CodecType}, option.Codecs...)
+	option.CodecType = ""
+	for _, typ := range candidates {
+		for _, s := range supported {
+			if typ != s {
+				continue
+			}
+			if f, ok := codec.Lookup(typ); ok {
+				option.CodecType = typ
+				return f
+			}
+		}
+	}
+	return nil
 }
 
 // 获取报文头部
@@ -136,27 +435,111 @@ type request struct {
 	argv, replyv reflect.Value
 	mtype        *methodType
 	svc          *service
+	// 携带请求的 metadata，处理请求的方法可以通过它设置回复的 metadata
+	// 连接关闭或者处理超时时 ctx 会被取消
+	ctx     context.Context
+	cancel  context.CancelFunc
+	replyMD *replyMetadata
 }
 
 var invalidRequest = struct{}{}
 
+// 客户端放弃一个请求时发送的控制消息，Seq 为被放弃的请求的序号
+// 服务端收到后取消对应请求的 ctx，并且不再回复它
+const cancelServiceMethod = "_minirpc.Cancel"
+
+// 一个连接上正在处理的请求，用于响应客户端的取消，以及在服务器关闭时判断连接是否空闲
+type inflight struct {
+	mu      sync.Mutex
+	cancels map[uint64]context.CancelFunc
+	// 服务器正在关闭，请求全部处理完毕后断开连接
+	draining bool
+}
+
+func (f *inflight) add(seq uint64, cancel context.CancelFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cancels == nil {
+		f.cancels = make(map[uint64]context.CancelFunc)
+	}
+	f.cancels[seq] = cancel
+}
+
+// 移除一个请求，返回连接是否已经可以断开
+func (f *inflight) remove(seq uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.cancels, seq)
+	return f.draining && len(f.cancels) == 0
+}
+
+func (f *inflight) cancel(seq uint64) {
+	f.mu.Lock()
+	cancel := f.cancels[seq]
+	f.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// 标记连接正在关闭，返回是否已经没有正在处理的请求
+func (f *inflight) drain() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.draining = true
+	return len(f.cancels) == 0
+}
+
 // 通过编码器处理后续请求，每个请求并发执行
-func (server *Server) handleCodec(cc codec.Codec, opt *Option) {
-	sending := new(sync.Mutex)
+func (server *Server) handleCodec(sc *serverConn, cc codec.Codec, sending *sync.Mutex, opt *Option) {
 	wg := new(sync.WaitGroup)
+	// 连接关闭时取消所有正在处理的请求
+	connCtx, cancel := context.WithCancel(context.Background())
+	calls := &sc.calls
 	for {
-		req, err := server.readRequest(cc)
+		req, err := server.readRequest(connCtx, cc)
+		if err == nil && req.header.ServiceMethod == cancelServiceMethod {
+			calls.cancel(req.header.Seq)
+			continue
+		}
 		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// 连头部都无法读取，或者 body 所在的帧已经损坏，说明连接已经不可用
+			if req == nil || errors.Is(err, codec.ErrChecksum) || errors.Is(err, codec.ErrTruncated) ||
+				(errors.Is(err, codec.ErrFrameTooLarge) && !codec.Recoverable(err)) {
 				break
 			}
-			req.header.Error = err.Error()
-			go server.sendResponse(cc, req.header, req, sending)
+			req.cancel()
+			setStatus(req.header, err, CodeInvalidArgument)
+			req.header.Metadata = nil
+			go server.sendResponse(cc, req.header, invalidRequest, sending)
 			continue
 		}
+		seq, cancelReq := req.header.Seq, req.cancel
+		calls.add(seq, cancelReq)
+		req.cancel = func() {
+			// 服务器正在关闭时，最后一个请求处理完毕后由服务端断开连接
+			// 不依赖客户端在收到 GoAway 后主动断开
+			if calls.remove(seq) {
+				_ = sc.rwc.Close()
+			}
+			cancelReq()
+		}
 		wg.Add(1)
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		job := func() {
+			// 方法超时后仍在执行时，等待其返回，使工作池能够限制同时执行的方法数
+			if handled := server.handleRequest(cc, req, sending, wg, opt.HandleTimeout); handled != nil {
+				<-handled
+			}
+		}
+		if !server.dispatch(job) {
+			wg.Done()
+			req.cancel()
+			setStatus(req.header, ErrOverloaded, CodeOverloaded)
+			req.header.Metadata = nil
+			go server.sendResponse(cc, req.header, invalidRequest, sending)
+		}
 	}
+	cancel()
 	wg.Wait()
 	_ = cc.Close()
 }
@@ -166,7 +549,13 @@ func (server *Server) sendResponse(
 	cc codec.Codec, header *codec.Header, body interface{}, sending *sync.Mutex) {
 	sending.Lock()
 	defer sending.Unlock()
-	if err := cc.Write(header, body); err != nil {
+	err := cc.Write(header, body)
+	// 编码器在写入任何数据之前拒绝了 body，连接依然可用，改为回复错误
+	if errors.Is(err, codec.ErrRawMessageNotSupported) {
+		setStatus(header, err, CodeInternal)
+		err = cc.Write(header, invalidRequest)
+	}
+	if err != nil {
 		log.Println("rpc server: write response error:", err)
 	}
 }
@@ -175,7 +564,7 @@ func (server *Server) sendResponse(
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	var header codec.Header
 	if err := cc.ReadHeader(&header); err != nil {
-		if err != io.EOF && err != io.ErrUnexpectedEOF {
+		if err != io.EOF {
 			logrus.Error("read header error: ", err)
 		}
 		return nil, err
@@ -184,18 +573,47 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 }
 
 // 读取一个 request，包括 header 和 body
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
+// 只要 header 读取成功，即使出错也会返回 request，以便向客户端回复错误
+// request 的 ctx 派生自 connCtx，处理完毕后需要调用 req.cancel
+func (server *Server) readRequest(connCtx context.Context, cc codec.Codec) (*request, error) {
 	header, err := server.readRequestHeader(cc)
 	if err != nil {
 		return nil, err
 	}
+	// 控制消息只有 header 有意义
+	if header.ServiceMethod == cancelServiceMethod {
+		if err := cc.ReadBody(nil); err != nil {
+			return nil, err
+		}
+		return &request{header: header}, nil
+	}
 	req := &request{
 		header: header,
 	}
-	req.svc, req.mtype, err = server.findService(header.ServiceMethod)
+	// 继承客户端的截止时间
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if header.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(connCtx, header.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(connCtx)
+	}
+	req.ctx, req.replyMD = newRequestContext(ctx, header.Metadata)
+	req.cancel = cancel
+	// 已经过期的请求不需要解析 body
+	if header.Timeout < 0 {
+		err = Errorf(CodeDeadlineExceeded, "rpc server: request deadline exceeded before handling")
+	} else {
+		req.svc, req.mtype, err = server.findService(header.ServiceMethod)
+	}
 	if err != nil {
 		logrus.Error("minirpc.Server.readRequest: ", err)
-		return nil, err
+		// 跳过 body，保证后续的请求可以正常读取
+		if err := cc.ReadBody(nil); err != nil {
+			cancel()
+			return nil, err
+		}
+		return req, err
 	}
 	req.argv = req.mtype.newArgv()
 	req.replyv = req.mtype.newReply()
@@ -206,45 +624,94 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	}
 	if err := cc.ReadBody(argvi); err != nil {
 		logrus.Error("read body error: ", err)
-		return nil, err
+		return req, err
 	}
 	return req, nil
 }
 
 // 处理请求，并发送回应
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+// 超时后立即向客户端返回超时错误，方法稍后返回的结果会被丢弃
+// 方法超时后返回时，方法可能仍在执行，返回的 handled 在方法返回后关闭，否则返回 nil
+func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) (handled <-chan struct{}) {
 	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
-	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
-		if err != nil {
-			req.header.Error = err.Error()
-			server.sendResponse(cc, req.header, invalidRequest, sending)
-			sent <- struct{}{}
+	defer req.cancel()
+	// 方法自身的超时设置优先于客户端在 Option 中的设置
+	if req.mtype.timeout != 0 {
+		timeout = req.mtype.timeout
+	}
+	// 请求的截止时间更早时以截止时间为准
+	if t := req.header.Timeout; t > 0 && (timeout == 0 || t < timeout) {
+		timeout = t
+	}
+	// 在队列中等待时已经被客户端取消、已经过了截止时间，或者连接已经关闭
+	if req.ctx.Err() != nil {
+		return
+	}
+	if timeout == 0 {
+		err := server.invoke(req.ctx, req)
+		// 客户端已经放弃了这个请求，不再回复
+		if req.ctx.Err() != nil {
 			return
 		}
-		server.sendResponse(cc, req.header, req.replyv.Interface(), sending)
-		sent <- struct{}{}
-	}()
-
-	if timeout == 0 {
-		<-called
-		<-sent
+		server.reply(cc, req, err, sending)
 		return
 	}
 
+	// req.ctx 已经带有请求的截止时间，两者中较早的一个生效
+	ctx, cancel := context.WithTimeout(req.ctx, timeout)
+	defer cancel()
+	// 带缓冲，超时后方法所在的协程不会被阻塞，返回后自行退出，其结果被丢弃
+	called := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		called <- server.invoke(ctx, req)
+	}()
+	handled = done
+
 	select {
-	case <-called:
-		// 如果调用成功，则等待发送完成
-		<-sent
-	case <-time.After(timeout):
-		// 如果调用超时，则发送超时错误，并关闭连接
-		logrus.Error("minirpc.Server.handleRequest: call timeout")
+	case err := <-called:
+		// 客户端已经放弃了这个请求，或者连接已经关闭，不再回复
+		if req.ctx.Err() == context.Canceled {
+			return
+		}
+		// 方法可能恰好在超时的同时返回，此时同样按超时处理
+		if ctx.Err() != context.DeadlineExceeded {
+			server.reply(cc, req, err, sending)
+			return
+		}
+	case <-ctx.Done():
+		// 与 ctx 使用同一个计时，保证方法观察到的是 context.DeadlineExceeded
+		// 不是超时说明连接已经关闭，不需要回复
+		if ctx.Err() != context.DeadlineExceeded {
+			return
+		}
+	}
+	logrus.Errorf("minirpc.Server.handleRequest: %s handle timeout", req.header.ServiceMethod)
+	req.header.Metadata = nil
+	setStatus(req.header, ErrHandleTimeout.withDetails(map[string]string{"timeout": timeout.String()}), CodeDeadlineExceeded)
+	server.sendResponse(cc, req.header, invalidRequest, sending)
+	return
+}
+
+// 根据方法的返回值发送响应
+func (server *Server) reply(cc codec.Codec, req *request, err error, sending *sync.Mutex) {
+	// 回复中只携带处理请求时设置的 metadata
+	req.header.Metadata = req.replyMD.get()
+	if err != nil {
+		var pe *panicError
+		if errors.As(err, &pe) {
+			if server.rePanic {
+				panic(pe.value)
+			}
+			// panic 的值放在 Details 中，Message 与 ErrPanic 相同，客户端可以通过 errors.Is 判断
+			err = ErrPanic.withDetails(map[string]string{"method": pe.serviceMethod, "panic": fmt.Sprint(pe.value)})
+		}
+		setStatus(req.header, err, CodeUnknown)
 		server.sendResponse(cc, req.header, invalidRequest, sending)
-		_ = cc.Close()
+		return
 	}
+	server.sendResponse(cc, req.header, req.replyv.Interface(), sending)
 }
 
 // 使用默认的服务器监听
@@ -257,6 +724,11 @@ func Register(rcvr interface{}) error {
 	return DefaultServer.Register(rcvr)
 }
 
+// 以指定的服务名注册一个结构体的所有方法到默认的服务器
+func RegisterName(name string, rcvr interface{}, opts ...MethodOption) error {
+	return DefaultServer.RegisterName(name, rcvr, opts...)
+}
+
 const (
 	connected        = "200 Connected to minirpc"
 	defaultRPCPath   = "/_minirpc_"
@@ -1,24 +1,42 @@
 package minirpc
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"go/ast"
 	"reflect"
+	"runtime"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-// 被注册的方法只能有两个参数
-// 第一个是实际的参数，第二个是指针类型，表示返回值
+// 被注册的方法有两个参数，第一个是实际的参数，第二个是指针类型，表示返回值
+// 也可以在最前面再接收一个 context.Context
 type methodType struct {
 	// 要调用的方法
 	method reflect.Method
+	// 方法的第一个参数是否为 context.Context
+	withContext bool
 	// 参数的类型
 	ArgType reflect.Type
 	// 返回值的类型
 	ReplyType reflect.Type
 	// 方法被调用的次数
 	numCalls uint64
+	// 方法发生 panic 的次数
+	numPanics uint64
+	// 客户端调用时使用的方法名，默认与方法本身的名字相同
+	name string
+	// 服务端处理该方法的超时时间，0 表示使用连接的 HandleTimeout
+	timeout time.Duration
+	// 同时执行的数量上限，为 nil 时不限制
+	sem chan struct{}
+	// 方法是否幂等，会在握手时告知客户端，客户端据此决定失败后能否重试
+	idempotent bool
 }
 
 // 返回方法被调用的次数，通过 CAS 机制保证返回的过程中不会被修改
@@ -26,6 +44,31 @@ func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+// 返回方法发生 panic 的次数
+func (m *methodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
+// 返回服务端处理该方法的超时时间，0 表示使用连接的 HandleTimeout
+func (m *methodType) Timeout() time.Duration {
+	return m.timeout
+}
+
+// 返回同时执行的数量上限，0 表示不限制
+func (m *methodType) MaxConcurrency() int {
+	return cap(m.sem)
+}
+
+// 方法是否接收 context.Context
+func (m *methodType) ContextAware() bool {
+	return m.withContext
+}
+
+// 方法是否被标记为幂等
+func (m *methodType) Idempotent() bool {
+	return m.idempotent
+}
+
 // new 一个方法的参数类型
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
@@ -42,9 +85,9 @@ func (m *methodType) newReply() reflect.Value {
 	reply := reflect.New(m.ReplyType.Elem())
 	switch m.ReplyType.Elem().Kind() {
 	case reflect.Map:
-		reply.Elem().Set(reflect.MakeMap(m.ReplyType))
+		reply.Elem().Set(reflect.MakeMap(m.ReplyType.Elem()))
 	case reflect.Slice:
-		reply.Elem().Set(reflect.MakeSlice(m.ReplyType, 0, 0))
+		reply.Elem().Set(reflect.MakeSlice(m.ReplyType.Elem(), 0, 0))
 	}
 	return reply
 }
@@ -56,21 +99,33 @@ type service struct {
 	// 注册的结构体的类型
 	typ reflect.Type
 	// 注册的结构体本身，在调用其方法时需要做为第一个参数传入
+	// 由 RegisterFunc 注册的函数组成的服务没有结构体，此时为零值
 	rcvr reflect.Value
 	// 存储结构体所有符合条件的方法
 	method map[string]*methodType
+	// 只作用于该服务的拦截器
+	interceptors []Interceptor
 }
 
-func newService(rcvr interface{}) *service {
+// name 为空时使用结构体的名字做为服务名，此时结构体必须是可导出的
+func newService(name string, rcvr interface{}) (*service, error) {
+	if rcvr == nil {
+		return nil, errors.New("rpc: register nil receiver")
+	}
 	var svc = new(service)
 	svc.typ = reflect.TypeOf(rcvr)
 	svc.rcvr = reflect.ValueOf(rcvr)
-	svc.name = reflect.Indirect(svc.rcvr).Type().Name()
-	if !ast.IsExported(svc.name) {
-		logrus.Fatalf("%s is not exported", svc.name)
+	if name == "" {
+		name = reflect.Indirect(svc.rcvr).Type().Name()
+		if !ast.IsExported(name) {
+			return nil, fmt.Errorf("rpc: type %s is not exported", svc.typ)
+		}
+	} else if strings.Contains(name, ".") {
+		return nil, errors.New("rpc: invalid service name: " + name)
 	}
+	svc.name = name
 	svc.registerMethods()
-	return svc
+	return svc, nil
 }
 
 // 注册此服务的结构体的所有方法
@@ -78,52 +133,106 @@ func (svc *service) registerMethods() {
 	svc.method = make(map[string]*methodType)
 	for m := 0; m < svc.typ.NumMethod(); m++ {
 		method := svc.typ.Method(m)
-		mtype := method.Type
 		mname := method.Name
 		// 忽略不可导出的方法，即首字母不是大写的方法
 		if !ast.IsExported(mname) {
 			continue
 		}
-		// 忽略不是三个参数的方法
-		// 其中第一个参数一定是它本身，第二个参数是指针类型，第三个参数是返回值
-		if mtype.NumIn() != 3 {
-			continue
-		}
-		// 忽略返回值数量不为一的方法
-		if mtype.NumOut() != 1 {
-			continue
-		}
-		// 忽略返回值不是 error 的方法
-		if mtype.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
-			continue
-		}
-		argType, replyType := mtype.In(1), mtype.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
-			continue
-		}
-		// replyType 必须为指针类型
-		if replyType.Kind() != reflect.Ptr {
+		mtype, err := newMethodType(method, 1)
+		if err != nil {
 			continue
 		}
-		svc.method[mname] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
-		}
+		svc.method[mname] = mtype
 		logrus.Infof("minirpc server: register method %s.%s", svc.name, mname)
 	}
 }
 
+// 检查方法的签名，skip 为签名中接收者占用的参数个数，结构体的方法为 1，普通函数为 0
+// 除接收者外只能有两个参数，第一个是实际的参数，第二个是指针类型，表示返回值
+// 接收 context.Context 的方法在此之前多一个参数
+func newMethodType(method reflect.Method, skip int) (*methodType, error) {
+	mtype := method.Type
+	withContext := mtype.NumIn() == skip+3 && mtype.In(skip) == typeOfContext
+	if mtype.NumIn() != skip+2 && !withContext {
+		return nil, fmt.Errorf("rpc: method %s has wrong number of ins: %d", method.Name, mtype.NumIn()-skip)
+	}
+	// 返回值只能有一个，并且是 error
+	if mtype.NumOut() != 1 {
+		return nil, fmt.Errorf("rpc: method %s has wrong number of outs: %d", method.Name, mtype.NumOut())
+	}
+	if mtype.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		return nil, fmt.Errorf("rpc: method %s returns %s, not error", method.Name, mtype.Out(0))
+	}
+	argType, replyType := mtype.In(mtype.NumIn()-2), mtype.In(mtype.NumIn()-1)
+	if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		return nil, fmt.Errorf("rpc: method %s has unexported argument or reply type", method.Name)
+	}
+	// replyType 必须为指针类型
+	if replyType.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("rpc: method %s reply type is not a pointer: %s", method.Name, replyType)
+	}
+	return &methodType{
+		method:      method,
+		name:        method.Name,
+		withContext: withContext,
+		ArgType:     argType,
+		ReplyType:   replyType,
+	}, nil
+}
+
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // 是可导出的类型，或者是内建类型
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
+// 被调用的方法发生了 panic
+type panicError struct {
+	serviceMethod string
+	value         interface{}
+	stack         []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("rpc: %s panicked: %v", e.serviceMethod, e.value)
+}
+
+// 记录处理方法 m 时发生的 panic，返回对应的 *panicError
+func newPanicError(serviceMethod string, m *methodType, value interface{}) *panicError {
+	atomic.AddUint64(&m.numPanics, 1)
+	stack := make([]byte, 64<<10)
+	stack = stack[:runtime.Stack(stack, false)]
+	pe := &panicError{serviceMethod: serviceMethod, value: value, stack: stack}
+	logrus.Errorf("minirpc server: %v\n%s", pe, pe.stack)
+	return pe
+}
+
 // 调用指定的方法，并写入返回值到 reply 中
-func (s *service) call(m *methodType, args, reply reflect.Value) error {
+// 方法接收 context.Context 时会传入 ctx
+// 方法中的 panic 不在这里恢复，而是由 Server.invoke 在整个拦截器链的外层恢复
+// 方法的并发数达到上限时会等待，直到有空位或者 ctx 结束
+func (s *service) call(ctx context.Context, m *methodType, args, reply reflect.Value) error {
+	if m.sem != nil {
+		select {
+		case m.sem <- struct{}{}:
+			defer func() { <-m.sem }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, args, reply})
+	in := make([]reflect.Value, 0, 4)
+	// 通过 RegisterFunc 注册的函数没有接收者
+	if s.rcvr.IsValid() {
+		in = append(in, s.rcvr)
+	}
+	if m.withContext {
+		in = append(in, reflect.ValueOf(&ctx).Elem())
+	}
+	in = append(in, args, reply)
+	returnValues := f.Call(in)
 	// 返回值只能有一个，即 error
 	if len(returnValues) == 1 {
 		if returnValues[0].Interface() != nil {
@@ -132,3 +241,97 @@ func (s *service) call(m *methodType, args, reply reflect.Value) error {
 	}
 	return nil
 }
+
+// 注册服务时对单个方法或整个服务的配置，方法使用其在结构体中的名字指定
+type MethodOption func(svc *service) error
+
+// 为服务设置只作用于该服务的拦截器，服务级别的拦截器在服务器级别的拦截器之后执行
+// 多次指定时按顺序追加
+func WithServiceInterceptors(interceptors ...Interceptor) MethodOption {
+	return func(svc *service) error {
+		svc.interceptors = append(svc.interceptors[:len(svc.interceptors):len(svc.interceptors)], interceptors...)
+		return nil
+	}
+}
+
+// 根据方法在结构体中的名字查找方法
+func (svc *service) lookupMethod(name string) (*methodType, error) {
+	for _, m := range svc.method {
+		if m.method.Name == name {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("rpc: service %s has no method %s", svc.name, name)
+}
+
+// 设置服务端处理该方法的超时时间，优先于客户端在 Option 中设置的 HandleTimeout
+func MethodTimeout(method string, timeout time.Duration) MethodOption {
+	return func(svc *service) error {
+		m, err := svc.lookupMethod(method)
+		if err != nil {
+			return err
+		}
+		m.timeout = timeout
+		return nil
+	}
+}
+
+// 限制该方法同时执行的数量，超出的请求会等待，直到超时
+func MethodConcurrency(method string, n int) MethodOption {
+	return func(svc *service) error {
+		m, err := svc.lookupMethod(method)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return errors.New("rpc: max concurrency must be positive")
+		}
+		m.sem = make(chan struct{}, n)
+		return nil
+	}
+}
+
+// 将该方法标记为幂等，即重复执行不会产生额外的影响
+// 客户端在握手时得知哪些方法是幂等的，按 RetryPolicy 自动重试失败的调用
+func MethodIdempotent(method string) MethodOption {
+	return func(svc *service) error {
+		m, err := svc.lookupMethod(method)
+		if err != nil {
+			return err
+		}
+		m.idempotent = true
+		return nil
+	}
+}
+
+// 以新的名字对外提供该方法，原来的名字不再可用
+func MethodRename(method, name string) MethodOption {
+	return func(svc *service) error {
+		m, err := svc.lookupMethod(method)
+		if err != nil {
+			return err
+		}
+		if name == "" || strings.Contains(name, ".") {
+			return errors.New("rpc: invalid method name: " + name)
+		}
+		if other, ok := svc.method[name]; ok && other != m {
+			return fmt.Errorf("rpc: method %s.%s already defined", svc.name, name)
+		}
+		delete(svc.method, m.name)
+		m.name = name
+		svc.method[name] = m
+		return nil
+	}
+}
+
+// 不对外提供该方法
+func MethodExclude(method string) MethodOption {
+	return func(svc *service) error {
+		m, err := svc.lookupMethod(method)
+		if err != nil {
+			return err
+		}
+		delete(svc.method, m.name)
+		return nil
+	}
+}
@@ -1,12 +1,19 @@
 package minirpc
 
 import (
+	"context"
+	"fmt"
+	"minirpc/codec"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type Foo struct{}
 
+// 不可导出的类型
+type foo struct{}
+
 type Args struct {
 	A, B int
 }
@@ -17,6 +24,15 @@ func (f Foo) Sum(args Args, reply *int) error {
 	return nil
 }
 
+// 接收 context.Context 的方法
+func (f Foo) SumContext(ctx context.Context, args Args, reply *int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	*reply = args.A + args.B
+	return nil
+}
+
 // 不可导出方法
 func (f Foo) sum(args Args, reply *int) error {
 	*reply = args.A + args.B
@@ -30,21 +46,113 @@ func _assert(t *testing.T, ok bool, format string, args ...interface{}) {
 }
 
 func TestNewService(t *testing.T) {
-	_assert(t, newService(Foo{}) != nil, "NewService failed")
-	svc := newService(Foo{})
+	svc, err := newService("", Foo{})
+	_assert(t, err == nil && svc != nil, "NewService failed: %v", err)
 	_assert(t, svc.name == "Foo", "NewService failed")
-	_assert(t, len(svc.method) == 1, "NewService failed")
+	_assert(t, len(svc.method) == 2, "NewService failed")
 	_assert(t, svc.method["Sum"] != nil, "NewService failed")
+	_assert(t, svc.method["SumContext"].ContextAware(), "NewService failed")
 	_assert(t, svc.method["sum"] == nil, "NewService failed")
+
+	svc, err = newService("UserDB", Foo{})
+	_assert(t, err == nil && svc.name == "UserDB", "NewService with name failed: %v", err)
+	_, err = newService("", foo{})
+	_assert(t, err != nil, "unexported type should be rejected")
+	_, err = newService("User.DB", Foo{})
+	_assert(t, err != nil, "invalid name should be rejected")
 }
 
 func TestMethodType_Call(t *testing.T) {
-	svc := newService(Foo{})
+	svc, _ := newService("", Foo{})
 	mType := svc.method["Sum"]
 	args := mType.newArgv()
 	reply := mType.newReply()
 	args.Set(reflect.ValueOf(Args{1, 2}))
-	err := svc.call(mType, args, reply)
+	err := svc.call(context.Background(), mType, args, reply)
 	_assert(t, err == nil, "call failed")
 	_assert(t, *reply.Interface().(*int) == 3, "call failed")
+
+	mType = svc.method["SumContext"]
+	ctx, cancel := context.WithCancel(context.Background())
+	err = svc.call(ctx, mType, args, mType.newReply())
+	_assert(t, err == nil, "call failed: %v", err)
+	cancel()
+	err = svc.call(ctx, mType, args, mType.newReply())
+	_assert(t, err == context.Canceled, "expect context.Canceled, got %v", err)
+}
+
+type Panicker struct{}
+
+func (p Panicker) Boom(args int, reply *int) error {
+	panic("boom")
+}
+
+func TestServer_InvokePanic(t *testing.T) {
+	svc, _ := newService("", Panicker{})
+	mType := svc.method["Boom"]
+	newRequest := func() *request {
+		return &request{
+			header: &codec.Header{ServiceMethod: "Panicker.Boom"},
+			svc:    svc,
+			mtype:  mType,
+			argv:   mType.newArgv(),
+			replyv: mType.newReply(),
+		}
+	}
+	server := NewServer()
+	err := server.invoke(context.Background(), newRequest())
+	pe, ok := err.(*panicError)
+	_assert(t, ok, "expect *panicError, got %v", err)
+	_assert(t, pe.value == "boom" && len(pe.stack) > 0, "unexpected panic error: %v", pe)
+	_assert(t, mType.NumPanics() == 1, "expect 1 panic, got %d", mType.NumPanics())
+
+	// 拦截器可以自己恢复方法中的 panic
+	server.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("recovered: %v", r)
+			}
+		}()
+		return next(ctx, serviceMethod, args, reply)
+	})
+	err = server.invoke(context.Background(), newRequest())
+	_assert(t, err != nil && err.Error() == "recovered: boom", "unexpected error: %v", err)
+
+	// 拦截器中的 panic 同样会被恢复
+	server = NewServer()
+	server.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, next Invoker) error {
+		panic("interceptor")
+	})
+	err = server.invoke(context.Background(), newRequest())
+	pe, ok = err.(*panicError)
+	_assert(t, ok && pe.value == "interceptor", "expect *panicError, got %v", err)
+}
+
+func TestMethodOption(t *testing.T) {
+	svc, _ := newService("", Foo{})
+	opts := []MethodOption{
+		MethodRename("Sum", "Add"),
+		MethodExclude("SumContext"),
+		MethodTimeout("Sum", time.Second),
+		MethodConcurrency("Sum", 1),
+	}
+	for _, opt := range opts {
+		_assert(t, opt(svc) == nil, "apply option failed")
+	}
+	_assert(t, len(svc.method) == 1, "expect 1 method, got %d", len(svc.method))
+	mType := svc.method["Add"]
+	_assert(t, mType != nil && mType.Timeout() == time.Second && mType.MaxConcurrency() == 1, "option not applied")
+	_assert(t, MethodTimeout("Missing", time.Second)(svc) != nil, "unknown method should fail")
+	_assert(t, MethodRename("Sum", "Foo.Add")(svc) != nil, "invalid name should fail")
+
+	// 占满并发数后，后续的调用会等待直到 ctx 结束
+	mType.sem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	args := reflect.ValueOf(Args{1, 2})
+	err := svc.call(ctx, mType, args, mType.newReply())
+	_assert(t, err == context.DeadlineExceeded, "expect context.DeadlineExceeded, got %v", err)
+	<-mType.sem
+	err = svc.call(context.Background(), mType, args, mType.newReply())
+	_assert(t, err == nil, "call failed: %v", err)
 }
@@ -0,0 +1,144 @@
+package minirpc
+
+import (
+	"context"
+	"io"
+	"minirpc/codec"
+	"net"
+	"sync"
+)
+
+// 服务端通知客户端不要再发送新请求时使用的 ServiceMethod
+// 这类控制消息的 Seq 为 0，客户端的请求序号从 1 开始，不会与之冲突
+const goAwayServiceMethod = "_minirpc.GoAway"
+
+// 服务端持有的一个连接，用于在关闭服务器时通知客户端或者强制断开
+type serverConn struct {
+	rwc io.Closer
+	// 握手完成之前为 nil
+	cc      codec.Codec
+	sending *sync.Mutex
+	// 正在处理的请求
+	calls inflight
+}
+
+// 记录或移除一个监听器，服务器关闭后不再记录新的监听器
+func (server *Server) trackListener(l net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if add {
+		if server.inShutdown {
+			return false
+		}
+		if server.listeners == nil {
+			server.listeners = make(map[net.Listener]struct{})
+		}
+		server.listeners[l] = struct{}{}
+	} else {
+		delete(server.listeners, l)
+	}
+	return true
+}
+
+// 记录或移除一个连接，服务器关闭后不再记录新的连接
+func (server *Server) trackConn(sc *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if add {
+		if server.inShutdown {
+			return false
+		}
+		if server.conns == nil {
+			server.conns = make(map[*serverConn]struct{})
+		}
+		server.conns[sc] = struct{}{}
+		server.connWG.Add(1)
+	} else {
+		delete(server.conns, sc)
+		server.connWG.Done()
+	}
+	return true
+}
+
+// 握手完成后记录连接的编码器，返回服务器是否已经开始关闭
+func (server *Server) activateConn(sc *serverConn, cc codec.Codec, sending *sync.Mutex) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	sc.cc, sc.sending = cc, sending
+	return server.inShutdown
+}
+
+func (server *Server) shuttingDown() bool {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return server.inShutdown
+}
+
+// 标记服务器开始关闭并关闭所有监听器，调用时需持有 server.mu
+func (server *Server) closeListenersLocked() error {
+	server.inShutdown = true
+	var err error
+	for l := range server.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(server.listeners, l)
+	}
+	return err
+}
+
+// 通知客户端不要再发送新的请求，已经发送的请求仍会被处理
+// 请求全部处理完毕后服务端断开连接，没有正在处理的请求时立即断开
+func (server *Server) drainConn(sc *serverConn) {
+	header := &codec.Header{ServiceMethod: goAwayServiceMethod}
+	server.sendResponse(sc.cc, header, invalidRequest, sc.sending)
+	if sc.calls.drain() {
+		_ = sc.rwc.Close()
+	}
+}
+
+// 优雅地关闭服务器
+// 首先停止接受新的连接，并通知所有客户端不要再发送新的请求
+// 然后等待已经收到的请求全部处理完毕，每个连接在其上的请求全部返回后断开
+// ctx 结束时仍未断开的连接会被强制关闭，此时返回 ctx.Err()
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	err := server.closeListenersLocked()
+	var conns []*serverConn
+	for sc := range server.conns {
+		if sc.cc != nil {
+			conns = append(conns, sc)
+		}
+	}
+	server.mu.Unlock()
+
+	for _, sc := range conns {
+		server.drainConn(sc)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.connWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		server.stopWorkers()
+		return err
+	case <-ctx.Done():
+		_ = server.Close()
+		return ctx.Err()
+	}
+}
+
+// 立即关闭服务器的所有监听器和连接，正在处理的请求的 ctx 会被取消，工作池随之停止
+func (server *Server) Close() error {
+	server.mu.Lock()
+	err := server.closeListenersLocked()
+	for sc := range server.conns {
+		_ = sc.rwc.Close()
+	}
+	server.mu.Unlock()
+	server.stopWorkers()
+	return err
+}
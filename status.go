@@ -0,0 +1,102 @@
+package minirpc
+
+import (
+	"errors"
+	"fmt"
+	"minirpc/codec"
+	"strconv"
+)
+
+// 错误码，随响应的 header 传输，用于区分错误的类别
+type Code uint32
+
+const (
+	// 没有指明类别的错误，方法返回的普通 error 都属于此类
+	CodeUnknown Code = iota
+	// 找不到请求的服务或方法
+	CodeNotFound
+	// 请求的参数无法解析或者不合法
+	CodeInvalidArgument
+	// 处理请求的时间超过了限制
+	CodeDeadlineExceeded
+	// 服务暂时不可用，通常可以稍后重试
+	CodeUnavailable
+	// 服务端内部错误
+	CodeInternal
+	// 服务器过载，请求没有被处理，可以在其他服务器上重试
+	CodeOverloaded
+	// 请求没有通过认证
+	CodeUnauthenticated
+	// 方法发生了 panic，只由服务端在恢复 panic 时使用
+	CodePanic
+)
+
+var codeNames = [...]string{
+	CodeUnknown:          "Unknown",
+	CodeNotFound:         "NotFound",
+	CodeInvalidArgument:  "InvalidArgument",
+	CodeDeadlineExceeded: "DeadlineExceeded",
+	CodeUnavailable:      "Unavailable",
+	CodeInternal:         "Internal",
+	CodeOverloaded:       "Overloaded",
+	CodeUnauthenticated:  "Unauthenticated",
+	CodePanic:            "Panic",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
+
+// Status 是带有错误码的错误
+// 方法或拦截器返回 *Status（或者包装了它的错误）时，错误码和 Details 会原样传给客户端
+// 客户端收到的服务端错误都是 *Status，可以通过 errors.As 获取，也可以通过 errors.Is 按错误码判断
+type Status struct {
+	Code    Code
+	Message string
+	// 附加的错误详情，如出错的字段名
+	Details map[string]string
+}
+
+// 创建一个带有错误码的错误
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+func (s *Status) Error() string {
+	if s.Message == "" {
+		return "rpc: " + s.Code.String()
+	}
+	return s.Message
+}
+
+// target 没有 Message 时按错误码匹配，如 errors.Is(err, &Status{Code: CodeUnavailable}) 对任何 CodeUnavailable 的错误都成立
+// 否则还要求 Message 相同，如 errors.Is(err, ErrHandleTimeout) 只对服务端处理超时的错误成立，而不是任何 CodeDeadlineExceeded 的错误
+func (s *Status) Is(target error) bool {
+	t, ok := target.(*Status)
+	return ok && t.Code == s.Code && (t.Message == "" || t.Message == s.Message)
+}
+
+// 返回附带了 details 的副本，副本与 s 仍然是同一个错误
+func (s *Status) withDetails(details map[string]string) *Status {
+	return &Status{Code: s.Code, Message: s.Message, Details: details}
+}
+
+// 将错误写入响应的 header，err 中没有 *Status 时使用 code 做为错误码
+func setStatus(header *codec.Header, err error, code Code) {
+	header.Error = err.Error()
+	header.Details = nil
+	var st *Status
+	if errors.As(err, &st) {
+		code = st.Code
+		header.Details = st.Details
+	}
+	header.Code = uint32(code)
+}
+
+// 从 header 中还原服务端返回的错误
+func statusFromHeader(header *codec.Header) *Status {
+	return &Status{Code: Code(header.Code), Message: header.Error, Details: header.Details}
+}
@@ -0,0 +1,90 @@
+package minirpc
+
+import "sync/atomic"
+
+// 服务器的工作池已满，请求没有被处理，可以安全地在其他服务器上重试
+var ErrOverloaded = &Status{Code: CodeOverloaded, Message: "rpc: server overloaded"}
+
+// 使用固定数量的协程处理请求，等待处理的请求最多有 queueSize 个
+// 队列已满时服务器直接返回 ErrOverloaded，而不是无限制地创建协程
+// 默认每个请求使用一个新的协程处理
+func WithWorkerPool(workers, queueSize int) ServerOption {
+	return func(server *Server) {
+		if workers <= 0 {
+			return
+		}
+		if queueSize < 0 {
+			queueSize = 0
+		}
+		server.workers = workers
+		server.jobs = make(chan func(), queueSize)
+	}
+}
+
+// 工作池的运行状态
+type PoolStats struct {
+	// 工作协程的数量，即同时执行的方法数的上限，0 表示没有使用工作池
+	Workers int
+	// 队列的容量
+	QueueSize int
+	// 正在排队等待处理的请求数
+	Queued int
+	// 因队列已满而被拒绝的请求数
+	Rejected uint64
+}
+
+// 返回工作池的运行状态
+func (server *Server) PoolStats() PoolStats {
+	return PoolStats{
+		Workers:   server.workers,
+		QueueSize: cap(server.jobs),
+		Queued:    len(server.jobs),
+		Rejected:  atomic.LoadUint64(&server.rejected),
+	}
+}
+
+// 启动工作协程，工作协程在服务器关闭时退出
+// 每个工作协程在方法真正返回之后才会处理下一个请求，即使请求已经超时
+// 因此同时执行的方法不会超过 workers 个
+func (server *Server) startWorkers() {
+	for i := 0; i < server.workers; i++ {
+		go func() {
+			for job := range server.jobs {
+				job()
+			}
+		}()
+	}
+}
+
+// 停止工作池，队列中剩余的请求仍会被取出处理
+func (server *Server) stopWorkers() {
+	server.poolMu.Lock()
+	defer server.poolMu.Unlock()
+	if server.jobs == nil || server.poolStopped {
+		return
+	}
+	server.poolStopped = true
+	close(server.jobs)
+}
+
+// 将请求交给工作池处理，队列已满时返回 false
+// 工作池停止后，连接上残留的请求使用新的协程处理
+func (server *Server) dispatch(job func()) bool {
+	if server.jobs == nil {
+		go job()
+		return true
+	}
+	server.poolMu.RLock()
+	defer server.poolMu.RUnlock()
+	if server.poolStopped {
+		go job()
+		return true
+	}
+	select {
+	case server.jobs <- job:
+		return true
+	default:
+		atomic.AddUint64(&server.rejected, 1)
+		return false
+	}
+}
@@ -2,9 +2,11 @@ package xclient
 
 import (
 	"context"
+	"math/rand"
 	"minirpc"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -13,16 +15,36 @@ type XClient struct {
 	d    Discovery
 	mode SelectMode
 	opt  *minirpc.Option
+	// 重试策略，建立连接使用的 opt 中不包含它，避免在同一个连接上重复重试
+	retry *minirpc.RetryPolicy
+	// 包裹 Call 和 Broadcast 的拦截器，由 mu 保护
+	interceptors []minirpc.Interceptor
 	// 已经建立好对应服务器的连接的客户端，可以复用
 	clients map[string]*minirpc.Client
 	mu      sync.Mutex
 }
 
+// 没有设置 RetryPolicy 时，只重试没有被服务器处理的请求，如服务器过载、服务器正在关闭而无法连接
+// 幂等的方法在服务器不可用时也会重试
+var defaultRetryPolicy = &minirpc.RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+}
+
+// opt.RetryPolicy 中的重试会换到 Discovery 选择的其他服务器上进行
 func NewXClient(d Discovery, mode SelectMode, opt *minirpc.Option) *XClient {
+	retry := defaultRetryPolicy
+	if opt != nil && opt.RetryPolicy != nil {
+		o := *opt
+		retry, o.RetryPolicy = o.RetryPolicy, nil
+		opt = &o
+	}
 	return &XClient{
 		d:       d,
 		mode:    mode,
 		opt:     opt,
+		retry:   retry,
 		clients: make(map[string]*minirpc.Client),
 	}
 }
@@ -44,9 +66,12 @@ func (c *XClient) dial(rpcAddr string) (*minirpc.Client, error) {
 	defer c.mu.Unlock()
 	client, ok := c.clients[rpcAddr]
 	// 如果客户端已不再可用，则关闭并删除
+	// 服务端正在关闭的连接上还有未返回的请求，只删除不关闭，它会在请求全部返回后自行断开
 	if ok && !client.Avaliable() {
-		client.Close()
-		logrus.Warn("client is not avaliable, close it")
+		if !client.Draining() {
+			client.Close()
+			logrus.Warn("client is not avaliable, close it")
+		}
 		delete(c.clients, rpcAddr)
 		client = nil
 	}
@@ -72,18 +97,106 @@ func (c *XClient) call(
 	return client.Call(ctx, serviceMethod, args, reply)
 }
 
+// 添加拦截器，作用于之后通过 Call 和 Broadcast 发起的所有调用
+// 拦截器包裹整个调用，包括其中的重试和广播，可以与服务端共用同一个拦截器
+func (c *XClient) Use(interceptors ...minirpc.Interceptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interceptors = append(c.interceptors[:len(c.interceptors):len(c.interceptors)], interceptors...)
+}
+
+// 经过拦截器调用 final
+func (c *XClient) intercept(final minirpc.Invoker) minirpc.Invoker {
+	c.mu.Lock()
+	interceptors := c.interceptors
+	c.mu.Unlock()
+	return minirpc.ChainInterceptors(interceptors, final)
+}
+
 // 选择一个服务器发起调用
+// 失败的调用按 RetryPolicy 重试，每次重试都尽量换一个 Discovery 选择的其他服务器
 func (c *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	return c.intercept(c.invoke)(ctx, serviceMethod, args, reply)
+}
+
+// 与服务器建立连接失败，请求没有发送出去
+// 可以通过 errors.Is 判断为 minirpc.ErrNotConnected，也可以取得建立连接时的原始错误
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string {
+	return minirpc.ErrNotConnected.Error() + ": " + e.err.Error()
+}
+
+func (e *dialError) Is(target error) bool {
+	return target == minirpc.ErrNotConnected
+}
+
+func (e *dialError) Unwrap() error {
+	return e.err
+}
+
+func (c *XClient) invoke(ctx context.Context, serviceMethod string, args, reply interface{}) error {
 	rpcAddr, err := c.d.Get(c.mode)
 	if err != nil {
 		return err
 	}
-	return c.call(ctx, rpcAddr, serviceMethod, args, reply)
+	for attempt := 1; ; attempt++ {
+		idempotent := c.retry.Idempotent(serviceMethod)
+		client, err := c.dial(rpcAddr)
+		if err != nil {
+			// 连接没有建立，请求没有发送出去
+			err = &dialError{err}
+		} else {
+			err = client.Call(ctx, serviceMethod, args, reply)
+			idempotent = idempotent || client.Idempotent(serviceMethod)
+		}
+		if err == nil || attempt >= c.retry.MaxAttempts || ctx.Err() != nil ||
+			!c.retry.Retryable(err, idempotent) {
+			return err
+		}
+		if !c.retry.Wait(ctx, attempt) {
+			return err
+		}
+		addr, e := c.next(rpcAddr)
+		if e != nil {
+			return err
+		}
+		logrus.Warnf("xclient: call %s on %s failed: %v, retry on %s", serviceMethod, rpcAddr, err, addr)
+		rpcAddr = addr
+	}
+}
+
+// 由 Discovery 选择下一个服务器，尽量不与 last 相同
+func (c *XClient) next(last string) (string, error) {
+	addr, err := c.d.Get(c.mode)
+	if err != nil || addr != last {
+		return addr, err
+	}
+	servers, err := c.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	var others []string
+	for _, s := range servers {
+		if s != last {
+			others = append(others, s)
+		}
+	}
+	if len(others) == 0 {
+		return last, nil
+	}
+	return others[rand.Intn(len(others))], nil
 }
 
 // Broadcast 将调用广播到所有的服务器，并给赋值给 reply 其中一个值
 // 如果有一个服务器返回错误，则返回错误
 func (c *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	return c.intercept(c.broadcast)(ctx, serviceMethod, args, reply)
+}
+
+func (c *XClient) broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
 	servers, err := c.d.GetAll()
 	if err != nil {
 		return err
@@ -0,0 +1,221 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"minirpc"
+	"net"
+	"testing"
+	"time"
+)
+
+// 进入 Wait 后阻塞，直到 release 被关闭
+type Slow struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newSlow() Slow {
+	return Slow{entered: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (s Slow) Wait(args int, reply *int) error {
+	s.entered <- struct{}{}
+	<-s.release
+	*reply = args
+	return nil
+}
+
+func (s Slow) Echo(args int, reply *int) error {
+	*reply = args
+	return nil
+}
+
+func startServer(t *testing.T, rcvr interface{}, opts ...minirpc.MethodOption) (*minirpc.Server, string) {
+	server := minirpc.NewServer()
+	if err := server.RegisterWithOptions(rcvr, opts...); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(listener)
+	t.Cleanup(func() { _ = server.Close() })
+	return server, "tcp://" + listener.Addr().String()
+}
+
+func TestXClient_Shutdown(t *testing.T) {
+	slow := newSlow()
+	serverA, addrA := startServer(t, slow)
+	_, addrB := startServer(t, newSlow())
+	d := NewMultiDiscovery([]string{addrA})
+	xc := NewXClient(d, SelectMode_RoundRobin, nil)
+	defer xc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	var reply int
+	go func() {
+		done <- xc.Call(ctx, "Slow.Wait", 1, &reply)
+	}()
+	<-slow.entered
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- serverA.Shutdown(ctx)
+	}()
+	for i := 0; ; i++ {
+		xc.mu.Lock()
+		draining := xc.clients[addrA].Draining()
+		xc.mu.Unlock()
+		if draining {
+			break
+		}
+		if i > 100 {
+			t.Fatal("client is not draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 新的调用换到其他服务器，正在关闭的连接不能被关闭
+	_ = d.Update([]string{addrA, addrB})
+	var echo int
+	if err := xc.Call(ctx, "Slow.Echo", 2, &echo); err != nil || echo != 2 {
+		t.Fatalf("call failed: %v", err)
+	}
+	close(slow.release)
+	if err := <-done; err != nil || reply != 1 {
+		t.Fatalf("in-flight call failed: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+}
+
+// code 不为 CodeUnknown 时总是返回该错误码的错误，否则返回 name
+type Node struct {
+	name string
+	code minirpc.Code
+}
+
+func (n Node) Get(args int, reply *string) error {
+	if n.code != minirpc.CodeUnknown {
+		return minirpc.Errorf(n.code, "%s failed", n.name)
+	}
+	*reply = n.name
+	return nil
+}
+
+func (n Node) Put(args int, reply *string) error {
+	return n.Get(args, reply)
+}
+
+func TestXClient_Retry(t *testing.T) {
+	_, unavailable := startServer(t, Node{"a", minirpc.CodeUnavailable}, minirpc.MethodIdempotent("Get"))
+	_, overloaded := startServer(t, Node{"a", minirpc.CodeOverloaded})
+	_, healthy := startServer(t, Node{"b", minirpc.CodeUnknown})
+	policy := &minirpc.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	cases := []struct {
+		name, first, serviceMethod string
+		policy                     *minirpc.RetryPolicy
+		code                       minirpc.Code
+	}{
+		{"idempotent", unavailable, "Node.Get", policy, minirpc.CodeUnknown},
+		{"not idempotent", unavailable, "Node.Put", policy, minirpc.CodeUnavailable},
+		{"overloaded by default", overloaded, "Node.Put", nil, minirpc.CodeUnknown},
+		{"unavailable by default", unavailable, "Node.Get", nil, minirpc.CodeUnknown},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// 轮询从第一个服务器开始，失败后由 Discovery 选择另一个服务器
+			d := NewMultiDiscovery([]string{c.first, healthy})
+			xc := NewXClient(d, SelectMode_RoundRobin, &minirpc.Option{
+				MagicNumber: minirpc.MagicNumber,
+				CodecType:   minirpc.DefaultCodecType,
+				RetryPolicy: c.policy,
+			})
+			defer xc.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			var reply string
+			err := xc.Call(ctx, c.serviceMethod, 1, &reply)
+			if c.code == minirpc.CodeUnknown {
+				if err != nil || reply != "b" {
+					t.Fatalf("expect reply from b, got %q, %v", reply, err)
+				}
+			} else if !errors.Is(err, &minirpc.Status{Code: c.code}) {
+				t.Fatalf("expect %v, got %v", c.code, err)
+			}
+		})
+	}
+}
+
+// 连接失败的错误既是 ErrNotConnected，也保留了原始的错误
+func TestXClient_DialError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := "tcp://" + listener.Addr().String()
+	listener.Close()
+	xc := NewXClient(NewMultiDiscovery([]string{dead}), SelectMode_RoundRobin, nil)
+	defer xc.Close()
+	var reply string
+	err = xc.Call(context.Background(), "Node.Get", 1, &reply)
+	var opErr *net.OpError
+	if !errors.Is(err, minirpc.ErrNotConnected) || !errors.As(err, &opErr) {
+		t.Fatalf("expect ErrNotConnected wrapping *net.OpError, got %v", err)
+	}
+}
+
+func TestXClient_Interceptors(t *testing.T) {
+	auth := func(ctx context.Context, serviceMethod string, args, reply interface{}, next minirpc.Invoker) error {
+		if md, _ := minirpc.MetadataFromContext(ctx); md["token"] != "secret" {
+			return minirpc.Errorf(minirpc.CodeUnauthenticated, "unauthenticated")
+		}
+		return next(ctx, serviceMethod, args, reply)
+	}
+	serverA, addrA := startServer(t, Node{"a", minirpc.CodeUnavailable}, minirpc.MethodIdempotent("Get"))
+	serverB, addrB := startServer(t, Node{"b", minirpc.CodeUnknown})
+	serverA.Use(auth)
+	serverB.Use(auth)
+
+	xc := NewXClient(NewMultiDiscovery([]string{addrA, addrB}), SelectMode_RoundRobin, &minirpc.Option{
+		MagicNumber: minirpc.MagicNumber,
+		CodecType:   minirpc.DefaultCodecType,
+		RetryPolicy: &minirpc.RetryPolicy{MaxAttempts: 2},
+	})
+	defer xc.Close()
+	var trace []string
+	xc.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, next minirpc.Invoker) error {
+		err := next(ctx, serviceMethod, args, reply)
+		trace = append(trace, serviceMethod)
+		return err
+	}, func(ctx context.Context, serviceMethod string, args, reply interface{}, next minirpc.Invoker) error {
+		return next(minirpc.WithMetadata(ctx, minirpc.Metadata{"token": "secret"}), serviceMethod, args, reply)
+	}, func(ctx context.Context, serviceMethod string, args, reply interface{}, next minirpc.Invoker) error {
+		if serviceMethod == "Node.Mock" {
+			*reply.(*string) = "mock"
+			return nil
+		}
+		return next(ctx, serviceMethod, args, reply)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var reply string
+	// 拦截器包裹整个调用，重试不会再次经过拦截器
+	if err := xc.Call(ctx, "Node.Get", 1, &reply); err != nil || reply != "b" {
+		t.Fatalf("expect reply from b, got %q, %v", reply, err)
+	}
+	if err := xc.Broadcast(ctx, "Node.Get", 1, &reply); !errors.Is(err, &minirpc.Status{Code: minirpc.CodeUnavailable}) {
+		t.Fatalf("expect CodeUnavailable, got %v", err)
+	}
+	if err := xc.Call(ctx, "Node.Mock", 1, &reply); err != nil || reply != "mock" {
+		t.Fatalf("mock failed: %q, %v", reply, err)
+	}
+	if len(trace) != 3 {
+		t.Fatalf("expect 3 intercepted calls, got %v", trace)
+	}
+}